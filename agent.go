@@ -15,87 +15,186 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-	"github.com/markkurossi/cloudsdk/api/auth"
+	"github.com/markkurossi/authorizer/broker"
+	ssh "github.com/markkurossi/authorizer/secsh/agent"
+	"github.com/markkurossi/authorizer/store"
 )
 
-var (
-	reAgentPath = regexp.MustCompilePOSIX(`^/agents/([a-zA-Z][a-zA-Z0-9]+)$`)
+const (
+	// AgentPresenceTimeout specifies how long an agent is considered
+	// online after it was last seen.
+	AgentPresenceTimeout = time.Minute
 )
 
-func Agents(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
+var (
+	reAgentID   = regexp.MustCompilePOSIX(`^[a-zA-Z][a-zA-Z0-9]+$`)
+	reAgentPath = regexp.MustCompilePOSIX(
+		`^/agents/([a-zA-Z][a-zA-Z0-9]+)(/info|/ack)?$`)
+)
 
-	token := auth.Authorize(w, r, REALM, tokenVerifier, nil)
-	if token == nil {
-		return
+func newAgentInfo(agent *store.Agent) *AgentInfo {
+	now := time.Now()
+	return &AgentInfo{
+		ID:           agent.ID,
+		Name:         agent.Name,
+		Owner:        agent.Owner,
+		Created:      agent.Created,
+		LastSeen:     agent.LastSeen,
+		Online:       now.Sub(agent.LastSeen) <= AgentPresenceTimeout,
+		Available:    !agent.Unavailable,
+		Fingerprints: agent.Fingerprints,
+		PublicKey:    agent.PublicKey,
 	}
+}
 
-	ctx := context.Background()
+// agentOnline tests if the agent has been seen within the presence
+// timeout and if its local SSH agent is available.
+func agentOnline(agent *store.Agent, now time.Time) bool {
+	return now.Sub(agent.LastSeen) <= AgentPresenceTimeout &&
+		!agent.Unavailable
+}
 
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		Error500f(w, "NewClient failed: %s", err)
+// Agents handles REST calls to the "/agents" URI.
+func (relay *Relay) Agents(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
+
+	principal := relay.authn.Authenticate(w, r)
+	if principal == nil {
 		return
 	}
 
+	ctx := r.Context()
+
 	switch r.Method {
+	case "GET":
+		if !requireScope(w, principal, ScopeClientConnect) {
+			return
+		}
+		agents, err := relay.store.ListAgents(ctx)
+		if err != nil {
+			Error500f(w, "ListAgents: %s", err)
+			return
+		}
+		result := new(AgentList)
+		for _, agent := range agents {
+			result.Agents = append(result.Agents, newAgentInfo(agent))
+		}
+		writeJSON(w, result)
+
 	case "POST":
 		// Register new agent.
-		topic := client.Topic(TOPIC_AUTHORIZER)
-		ok, err := topic.Exists(ctx)
+		key, ok := idempotencyKey(r)
+		if !ok {
+			Errorf(w, http.StatusBadRequest, "Invalid idempotency key")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			Error500f(w, "topic.Exists: %s", err)
+			Error500f(w, "ioutil.ReadAll: %s", err)
 			return
 		}
-		if !ok {
-			topic, err = client.CreateTopic(ctx, TOPIC_AUTHORIZER)
+		req := new(ServerConnectRequest)
+		if len(data) > 0 {
+			err = json.Unmarshal(data, req)
 			if err != nil {
-				Error500f(w, "client.CreateTopic: %s", err)
+				Errorf(w, http.StatusBadRequest, "Invalid request data: %s",
+					err)
+				return
+			}
+		}
+		agentID := req.ID
+		if len(agentID) == 0 {
+			if !requireScope(w, principal, ScopeAgentServe) {
 				return
 			}
+			var id ID
+			if len(key) > 0 {
+				// Retried requests register the agent that the
+				// first request created.
+				id = idempotentID(principal.Subject, key)
+			} else {
+				id, err = NewID()
+				if err != nil {
+					Error500f(w, "NewID: %s", err)
+					return
+				}
+			}
+			agentID = "a" + id.String()
+		} else if !reAgentID.MatchString(agentID) {
+			Errorf(w, http.StatusBadRequest, "Invalid agent ID '%s'", agentID)
+			return
+		} else if !requireScope(w, principal, agentScope(agentID),
+			ScopeAgentServe) {
+			return
 		}
 
-		sub := client.Subscription(SUB_REQUESTS)
-		ok, err = sub.Exists(ctx)
+		// Only the agent's owner can register it again.
+		old, err := relay.store.GetAgent(ctx, agentID)
+		if err == store.ErrNotFound {
+			old = nil
+		} else if err != nil {
+			Error500f(w, "GetAgent: %s", err)
+			return
+		} else if !authorized(principal, old.Subject) {
+			Errorf(w, http.StatusForbidden, "Access denied to agent %s",
+				agentID)
+			return
+		}
+
+		// Create a queue for requests.
+		err = relay.broker.CreateQueue(ctx, agentQueue(agentID))
 		if err != nil {
-			Error500f(w, "sub.Exists: %s", err)
+			Error500f(w, "CreateQueue: %s", err)
 			return
 		}
-		if !ok {
-			sub, err = client.CreateSubscription(ctx, SUB_REQUESTS,
-				pubsub.SubscriptionConfig{
-					Topic:            topic,
-					AckDeadline:      10 * time.Second,
-					ExpirationPolicy: 25 * time.Hour,
-				})
-			if err != nil {
-				Error500f(w, "client.CreateSubscription: %s", err)
-				return
-			}
+
+		now := time.Now()
+		agent := &store.Agent{
+			ID:        agentID,
+			Name:      req.Name,
+			Owner:     req.Owner,
+			Subject:   principal.Subject,
+			Created:   now,
+			LastSeen:  now,
+			PublicKey: req.PublicKey,
+		}
+		for _, id := range req.Identities {
+			agent.Fingerprints = append(agent.Fingerprints,
+				ssh.Fingerprint(id.Key))
+			agent.Identities = append(agent.Identities, store.Identity{
+				Key:     id.Key,
+				Comment: id.Comment,
+			})
 		}
-		result := &ServerConnectResult{
-			URL: "/agents/" + SUB_REQUESTS,
+		if old != nil {
+			agent.Created = old.Created
+			agent.Subject = old.Subject
 		}
-		data, err := json.Marshal(result)
+		err = relay.store.PutAgent(ctx, agent)
 		if err != nil {
-			Error500f(w, "json.Marshal: %s", err)
+			Error500f(w, "PutAgent: %s", err)
 			return
 		}
-		w.Write(data)
+
+		writeJSON(w, &ServerConnectResult{
+			URL: "/agents/" + agentID,
+			ID:  agentID,
+		})
 
 	default:
 		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
 	}
 }
 
-func Agent(w http.ResponseWriter, r *http.Request) {
+// Agent handles REST calls to the "/agents/{ID}" URI.
+func (relay *Relay) Agent(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
 
-	token := auth.Authorize(w, r, REALM, tokenVerifier, nil)
-	if token == nil {
+	principal := relay.authn.Authenticate(w, r)
+	if principal == nil {
 		return
 	}
 
@@ -106,62 +205,137 @@ func Agent(w http.ResponseWriter, r *http.Request) {
 	}
 	agentID := m[1]
 
-	ctx := context.Background()
+	ctx := r.Context()
 
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		Error500f(w, "NewClient failed: %s", err)
+	if m[2] == "/info" {
+		if !requireScope(w, principal, ScopeClientConnect) {
+			return
+		}
+		relay.agentInfo(ctx, w, r, agentID)
+		return
+	}
+	if !requireScope(w, principal, agentScope(agentID), ScopeAgentServe) {
+		return
+	}
+
+	// Only the agent's owner can serve its requests.
+	agent, err := relay.store.GetAgent(ctx, agentID)
+	if err == store.ErrNotFound {
+		Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+		return
+	} else if err != nil {
+		Error500f(w, "GetAgent: %s", err)
+		return
+	}
+	if !authorized(principal, agent.Subject) {
+		Errorf(w, http.StatusForbidden, "Access denied to agent %s", agentID)
 		return
 	}
 
-	sub := client.Subscription(agentID)
+	switch m[2] {
+	case "/ack":
+		relay.ack(ctx, w, r, agentQueue(agentID))
+		return
+	}
 
 	switch r.Method {
-	case "GET":
-		var request *pubsub.Message
+	case "GET", "PUT":
+		// Receives and heartbeats update the agent's presence.
+		err := relay.store.SetAgentLastSeen(ctx, agentID, time.Now())
+		if err == store.ErrNotFound {
+			Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+			return
+		} else if err != nil {
+			Error500f(w, "SetAgentLastSeen: %s", err)
+			return
+		}
+		if r.Method == "PUT" {
+			// The heartbeat can report the availability of the
+			// agent's local SSH agent.
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				Error500f(w, "ioutil.ReadAll: %s", err)
+				return
+			}
+			if len(data) > 0 {
+				status := new(AgentStatus)
+				err = json.Unmarshal(data, status)
+				if err != nil {
+					Errorf(w, http.StatusBadRequest,
+						"Invalid request data: %s", err)
+					return
+				}
+				err = relay.store.SetAgentAvailable(ctx, agentID,
+					status.Available)
+				if err != nil {
+					Error500f(w, "SetAgentAvailable: %s", err)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
 		cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		defer cancel()
 
-		// XXX Request processing must be moved inside receive
-		// function. We must ACK the message only if we correctly
-		// passed it to our caller.
-		err = sub.Receive(cctx, func(ctx context.Context, m *pubsub.Message) {
-			if false {
-				fmt.Printf("m: ID=%s, Data=%q, Attributes=%q\n",
-					m.ID, m.Data, m.Attributes)
+		var request *broker.Message
+		for {
+			request, err = relay.broker.Receive(cctx, agentQueue(agentID))
+			if err == broker.ErrQueueNotFound {
+				// The agent must register again.
+				Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+				return
+			} else if err != nil {
+				Error500f(w, "Receive: %s", err)
+				return
 			}
-			request = m
-			m.Ack()
-			cancel()
-		})
-		if err != nil {
-			Error500f(w, "sub.Receive: %s", err)
-			return
-		}
-		if request == nil {
-			w.WriteHeader(http.StatusRequestTimeout)
-			return
+			if request == nil {
+				w.WriteHeader(http.StatusRequestTimeout)
+				return
+			}
+			ok, err := relay.deliverable(ctx, request)
+			if err != nil {
+				Error500f(w, "deliverable: %s", err)
+				return
+			}
+			if ok {
+				break
+			}
+			relay.broker.Ack(ctx, agentQueue(agentID), request.AckID)
 		}
+		deadline, _ := parseDeadline(request.Attributes)
 
 		from, ok := request.Attributes[ATTR_RESPONSE]
 		if !ok {
+			// Drop the invalid message so it is not redelivered.
+			relay.broker.Ack(ctx, agentQueue(agentID), request.AckID)
 			Errorf(w, http.StatusBadRequest, "No sender ID in message")
 			return
 		}
 
+		// The message is acknowledged by the caller after it has
+		// received it. Unacknowledged messages are redelivered.
 		msg := &Message{
-			From: from,
+			Version:  ProtocolVersion,
+			Kind:     Kind(request.Attributes[ATTR_KIND]),
+			ID:       request.Attributes[ATTR_REQUEST_ID],
+			From:     from,
+			Agent:    agentID,
+			Channel:  request.Attributes[ATTR_CHANNEL],
+			AckID:    request.AckID,
+			Deadline: deadline,
+			Session:  request.Attributes[ATTR_SESSION],
 		}
 		msg.SetBytes(request.Data)
-		data, err := json.Marshal(msg)
-		if err != nil {
-			Error500f(w, "json.Marshal: %s", err)
-			return
-		}
-		w.Write(data)
+		writeJSON(w, msg)
 
 	case "POST":
+		key, ok := idempotencyKey(r)
+		if !ok {
+			Errorf(w, http.StatusBadRequest, "Invalid idempotency key")
+			return
+		}
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			Error500f(w, "ioutil.ReadAll: %s", err)
@@ -173,6 +347,18 @@ func Agent(w http.ResponseWriter, r *http.Request) {
 			Errorf(w, http.StatusBadRequest, "Invalid message data: %s", err)
 			return
 		}
+		if msg.Version > ProtocolVersion {
+			Errorf(w, http.StatusBadRequest,
+				"Unsupported protocol version %d", msg.Version)
+			return
+		}
+		switch msg.MessageKind() {
+		case KindData, KindPong, KindError, KindHandshake:
+		default:
+			Errorf(w, http.StatusBadRequest, "Invalid message kind '%s'",
+				msg.Kind)
+			return
+		}
 		payload, err := msg.Bytes()
 		if err != nil {
 			Errorf(w, http.StatusBadRequest, "Invalid message payload: %s", err)
@@ -184,15 +370,41 @@ func Agent(w http.ResponseWriter, r *http.Request) {
 				msg.To, err)
 			return
 		}
+		// Agents can only respond to the sessions that use them.
+		client, err := relay.store.GetClient(ctx, id.String())
+		if err == store.ErrNotFound {
+			Errorf(w, http.StatusNotFound, "Unknown client %s", id)
+			return
+		} else if err != nil {
+			Error500f(w, "GetClient: %s", err)
+			return
+		}
+		if !client.HasAgent(agentID) {
+			Errorf(w, http.StatusForbidden, "Access denied to client %s", id)
+			return
+		}
 
-		topic := client.Topic(id.Topic())
-		result := topic.Publish(ctx, &pubsub.Message{
-			Data: payload,
+		attrs := map[string]string{
+			ATTR_KIND:       string(msg.MessageKind()),
+			ATTR_REQUEST_ID: msg.ID,
+			ATTR_CHANNEL:    msg.Channel,
+		}
+		if msg.MessageKind() == KindError {
+			attrs[ATTR_ERROR_CODE] = strconv.Itoa(int(msg.Code))
+			attrs[ATTR_REASON] = msg.Reason
+		}
+		if len(msg.Session) > 0 {
+			attrs[ATTR_SESSION] = msg.Session
+		}
+		err = relay.publish(ctx, clientQueue(id), key, &broker.Message{
+			Data:       payload,
+			Attributes: attrs,
 		})
-		_, err = result.Get(ctx)
-		topic.Stop()
-		if err != nil {
-			Error500f(w, "topic.Publish: %s", err)
+		if err == broker.ErrQueueNotFound {
+			Errorf(w, http.StatusNotFound, "Unknown client %s", id)
+			return
+		} else if err != nil {
+			Error500f(w, "Publish: %s", err)
 			return
 		}
 
@@ -201,18 +413,70 @@ func Agent(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleRequest(client *pubsub.Client, req *pubsub.Message) error {
-	topicID, ok := req.Attributes["response"]
+// agentInfo handles REST calls to the "/agents/{ID}/info" URI.
+func (relay *Relay) agentInfo(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, agentID string) {
+
+	switch r.Method {
+	case "GET":
+		agent, err := relay.store.GetAgent(ctx, agentID)
+		if err == store.ErrNotFound {
+			Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+			return
+		} else if err != nil {
+			Error500f(w, "GetAgent: %s", err)
+			return
+		}
+		writeJSON(w, newAgentInfo(agent))
+
+	default:
+		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
+	}
+}
+
+// parseDeadline parses the request deadline from the message
+// attributes. It returns zero time if the request has no deadline.
+func parseDeadline(attrs map[string]string) (time.Time, error) {
+	value, ok := attrs[ATTR_DEADLINE]
 	if !ok {
-		return fmt.Errorf("No response ID in request")
+		return time.Time{}, nil
 	}
-	ctx := context.Background()
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// deliverable tests if the request can be delivered to the agent.
+// Expired and cancelled requests, and requests from closed client
+// sessions are dropped since their clients have given up on them.
+func (relay *Relay) deliverable(ctx context.Context,
+	request *broker.Message) (bool, error) {
 
-	topic := client.Topic(topicID)
-	defer topic.Stop()
-	result := topic.Publish(ctx, &pubsub.Message{
-		Data: []byte("Hello, Client!"),
-	})
-	_, err := result.Get(ctx)
-	return err
+	requestID := request.Attributes[ATTR_REQUEST_ID]
+
+	deadline, err := parseDeadline(request.Attributes)
+	if err != nil || (!deadline.IsZero() && !time.Now().Before(deadline)) {
+		fmt.Printf("Dropping expired request %s\n", requestID)
+		return false, nil
+	}
+	switch Kind(request.Attributes[ATTR_KIND]) {
+	case KindCancel, KindClose:
+		// Control messages are delivered also for closed sessions.
+		return true, nil
+	}
+	from, ok := request.Attributes[ATTR_RESPONSE]
+	if !ok {
+		return true, nil
+	}
+	client, err := relay.store.GetClient(ctx, from)
+	if err == store.ErrNotFound {
+		fmt.Printf("Dropping request %s of closed session %s\n",
+			requestID, from)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if client.IsCancelled(requestID) {
+		fmt.Printf("Dropping cancelled request %s\n", requestID)
+		return false, nil
+	}
+	return true, nil
 }
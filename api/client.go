@@ -9,51 +9,141 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/markkurossi/authorizer"
+	"github.com/markkurossi/authorizer/noise"
 )
 
+var (
+	// ErrSessionExpired is returned when the client session's lease
+	// has expired.
+	ErrSessionExpired = errors.New("session expired")
+
+	// ErrAgentOffline is returned by Call when the request's agent
+	// is not online.
+	ErrAgentOffline = errors.New("agent offline")
+)
+
+// RemoteError is returned by Call when the agent fails to process the
+// request.
+type RemoteError struct {
+	Code   authorizer.ErrorCode
+	Reason string
+}
+
+func (err *RemoteError) Error() string {
+	if len(err.Reason) == 0 {
+		return err.Code.String()
+	}
+	return fmt.Sprintf("%s: %s", err.Code, err.Reason)
+}
+
+// VersionError is returned when a received message uses an
+// unsupported protocol version.
+type VersionError struct {
+	Version int
+}
+
+func (err *VersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d", err.Version)
+}
+
 type Client struct {
-	http    *http.Client
-	baseURL string
-	url     string
-	id      string
+	http        *httpClient
+	baseURL     string
+	agents      []string
+	reconnectM  sync.Mutex
+	m           sync.Mutex
+	url         string
+	id          string
+	agent       string
+	lease       time.Duration
+	done        chan struct{}
+	nextID      uint64
+	nextChannel uint64
+	pending     map[string]chan *callResult
+	polling     bool
+
+	e2eM      sync.Mutex
+	static    *noise.KeyPair
+	verifyKey AgentKeyCallback
+	sessions  map[string]*clientSession
+	keyAgents map[string]string
 }
 
-func NewClient(endpoint string) (*Client, error) {
+// NewClient creates a new client for the relay endpoint. If the token
+// source is not nil, the relay requests are authorized with its
+// tokens.
+func NewClient(endpoint string, tokens TokenSource) (*Client, error) {
 	return &Client{
-		http:    new(http.Client),
+		http:    newHTTPClient(tokens),
 		baseURL: canonizeEndpoint(endpoint),
+		pending: make(map[string]chan *callResult),
 	}, nil
 }
 
+// SetRetryPolicy sets the retry policy of the client's HTTP requests.
+func (client *Client) SetRetryPolicy(policy RetryPolicy) {
+	client.http.retry = policy
+}
+
 func (client *Client) ID() string {
-	parts := strings.Split(client.url, "/")
-	return parts[len(parts)-1]
+	client.m.Lock()
+	defer client.m.Unlock()
+	return client.id
 }
 
-func (client *Client) Connect() error {
-	req, err := http.NewRequest("POST", client.baseURL+"/clients", nil)
+// session returns the URL, client ID, and primary agent of the
+// current session.
+func (client *Client) session() (string, string, string) {
+	client.m.Lock()
+	defer client.m.Unlock()
+	return client.url, client.id, client.agent
+}
+
+// Connect creates a new client session for sending requests to the
+// agents. The requests are routed to the agent that holds the
+// request's key. Other requests are passed to the first agent. If the
+// session expires, the client reconnects automatically.
+func (client *Client) Connect(agents ...string) error {
+	return client.ConnectContext(context.Background(), agents...)
+}
+
+// ConnectContext is like Connect but the context bounds the HTTP
+// requests.
+func (client *Client) ConnectContext(ctx context.Context,
+	agents ...string) error {
+
+	if len(agents) == 0 {
+		return fmt.Errorf("no agents specified")
+	}
+	data, err := json.Marshal(&authorizer.ClientConnectRequest{
+		Agent:  agents[0],
+		Agents: agents,
+	})
 	if err != nil {
 		return err
 	}
-
-	resp, err := client.http.Do(req)
+	key, err := newIdempotencyKey()
 	if err != nil {
 		return err
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	status, data, err := client.http.do(ctx, "POST",
+		client.baseURL+"/clients", data, key)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return httpError(resp.StatusCode, data)
+	if status != http.StatusOK {
+		return httpError(status, data)
 	}
 
 	response := new(authorizer.ClientConnectResult)
@@ -61,82 +151,529 @@ func (client *Client) Connect() error {
 	if err != nil {
 		return err
 	}
+
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	client.agents = agents
 	client.url = client.baseURL + response.URL
 	client.id = response.ID
+	client.agent = response.Agent
+	client.lease = time.Duration(response.Lease) * time.Second
+
+	if client.done != nil {
+		close(client.done)
+		client.done = nil
+	}
+	if client.lease > 0 {
+		client.done = make(chan struct{})
+		go client.renewer(client.url, client.lease, client.done)
+	}
 
 	return nil
 }
 
-func (client *Client) Disconnect() error {
-	req, err := http.NewRequest("DELETE", client.url, nil)
-	if err != nil {
-		return err
+// reconnect creates a new session if the session url has expired.
+// Concurrent callers reconnect only once.
+func (client *Client) reconnect(ctx context.Context, url string) error {
+	client.reconnectM.Lock()
+	defer client.reconnectM.Unlock()
+
+	client.m.Lock()
+	current := client.url
+	agents := client.agents
+	client.m.Unlock()
+
+	if current != url {
+		// Already reconnected.
+		return nil
+	}
+	log.Printf("Client session %s expired, reconnecting\n", url)
+	return client.ConnectContext(ctx, agents...)
+}
+
+// renewer renews the session's lease until the done channel is
+// closed. If the session expires, renewer reconnects the client.
+func (client *Client) renewer(url string, lease time.Duration,
+	done chan struct{}) {
+
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			err := client.renew(ctx, url)
+			if err == ErrSessionExpired {
+				err = client.reconnect(ctx, url)
+				if err != nil {
+					log.Printf("Reconnect failed: %s\n", err)
+					continue
+				}
+				return
+			} else if err != nil {
+				log.Printf("Failed to renew session %s: %s\n", url, err)
+			}
+		}
 	}
+}
 
-	resp, err := client.http.Do(req)
+// renew renews the session's lease.
+func (client *Client) renew(ctx context.Context, url string) error {
+	status, data, err := client.http.do(ctx, "PUT", url, nil, "")
 	if err != nil {
 		return err
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone, http.StatusNotFound:
+		return ErrSessionExpired
+	default:
+		return httpError(status, data)
+	}
+}
+
+// Disconnect closes the client session.
+func (client *Client) Disconnect() error {
+	return client.DisconnectContext(context.Background())
+}
+
+// DisconnectContext is like Disconnect but the context bounds the
+// HTTP request.
+func (client *Client) DisconnectContext(ctx context.Context) error {
+	client.m.Lock()
+	if client.done != nil {
+		close(client.done)
+		client.done = nil
+	}
+	url := client.url
+	client.m.Unlock()
+
+	status, data, err := client.http.do(ctx, "DELETE", url, nil, "")
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return httpError(resp.StatusCode, data)
+	if status != http.StatusOK {
+		return httpError(status, data)
 	}
 	return nil
 }
 
+// Call sends the message to the agent and returns the agent's
+// response. Call can be called concurrently from multiple goroutines.
 func (client *Client) Call(msg []byte) ([]byte, error) {
+	return client.call(context.Background(), authorizer.KindData, "", msg)
+}
+
+// CallContext is like Call but the request and its HTTP requests
+// carry the context's deadline. The relay and the agent drop requests
+// whose deadline has passed. CallContext returns the context's error
+// if the context is done before the response is received.
+func (client *Client) CallContext(ctx context.Context, msg []byte) (
+	[]byte, error) {
+	return client.call(ctx, authorizer.KindData, "", msg)
+}
+
+// Ping sends a ping message to the agent and returns the round-trip
+// time.
+func (client *Client) Ping() (time.Duration, error) {
+	return client.PingContext(context.Background())
+}
+
+// PingContext is like Ping but the ping carries the context's
+// deadline.
+func (client *Client) PingContext(ctx context.Context) (
+	time.Duration, error) {
+
+	start := time.Now()
+	_, err := client.call(ctx, authorizer.KindPing, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// NewChannel creates a new logical channel in the client session.
+func (client *Client) NewChannel() *Channel {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	client.nextChannel++
+	return &Channel{
+		client: client,
+		id:     strconv.FormatUint(client.nextChannel, 10),
+	}
+}
+
+// Channel implements a logical channel in a multiplexed client
+// session.
+type Channel struct {
+	client *Client
+	id     string
+}
+
+// ID returns the channel ID.
+func (ch *Channel) ID() string {
+	return ch.id
+}
+
+// Call sends the message to the agent over the channel and returns
+// the agent's response.
+func (ch *Channel) Call(msg []byte) ([]byte, error) {
+	return ch.client.call(context.Background(), authorizer.KindData, ch.id,
+		msg)
+}
+
+// CallContext is like Call but the request carries the context's
+// deadline.
+func (ch *Channel) CallContext(ctx context.Context, msg []byte) (
+	[]byte, error) {
+	return ch.client.call(ctx, authorizer.KindData, ch.id, msg)
+}
+
+type callResult struct {
+	env  *authorizer.Message
+	data []byte
+	err  error
+}
+
+func (client *Client) call(ctx context.Context, kind authorizer.Kind,
+	channel string, msg []byte) ([]byte, error) {
+
+	if kind == authorizer.KindData && client.encrypted() {
+		return client.callEncrypted(ctx, channel, msg)
+	}
+	return client.do(ctx, &request{
+		kind:    kind,
+		channel: channel,
+		payload: msg,
+	})
+}
+
+// request specifies an agent call.
+type request struct {
+	kind    authorizer.Kind
+	agent   string
+	channel string
+	session string
+	e2e     *clientSession
+	payload []byte
+}
+
+// do does the call. If the session has expired, do reconnects and
+// retries the call once.
+func (client *Client) do(ctx context.Context, req *request) ([]byte, error) {
+	for retry := false; ; retry = true {
+		url, data, err := client.callSession(ctx, req)
+		if err == ErrSessionExpired && !retry {
+			err = client.reconnect(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return data, err
+	}
+}
+
+// callSession does the call in the current session. It returns the
+// session URL and the call result.
+func (client *Client) callSession(ctx context.Context, req *request) (
+	string, []byte, error) {
+
+	url, from, agent := client.session()
+	if len(req.agent) > 0 {
+		agent = req.agent
+	}
+
+	result := make(chan *callResult, 1)
+
+	client.m.Lock()
+	client.nextID++
+	requestID := strconv.FormatUint(client.nextID, 10)
+	client.pending[requestID] = result
+	client.m.Unlock()
+
 	envelope := &authorizer.Message{
-		From: client.id,
+		Version: authorizer.ProtocolVersion,
+		Kind:    req.kind,
+		ID:      requestID,
+		From:    from,
+		Agent:   agent,
+		Channel: req.channel,
+		Session: req.session,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		envelope.Deadline = deadline
+	}
+	payload := req.payload
+	if req.e2e != nil {
+		envelope.Session = req.e2e.id
+		sealed, err := req.e2e.transport.Seal(e2eAD(req.e2e.agent, envelope),
+			payload)
+		if err != nil {
+			client.fail(requestID, err)
+			return url, nil, err
+		}
+		payload = sealed
 	}
-	envelope.SetBytes(msg)
+	envelope.SetBytes(payload)
 
 	data, err := json.Marshal(envelope)
 	if err != nil {
-		return nil, err
+		client.fail(requestID, err)
+		return url, nil, err
+	}
+	key, err := newIdempotencyKey()
+	if err != nil {
+		client.fail(requestID, err)
+		return url, nil, err
 	}
 
-	req, err := http.NewRequest("POST", client.url, bytes.NewReader(data))
+	// The POST returns the next response from the session which is
+	// not necessarily ours. Our response can arrive from any of the
+	// concurrent receives so we must not block on the POST.
+	go func() {
+		err := client.receive(ctx, "POST", url, data, key)
+		if err != nil {
+			client.fail(requestID, err)
+		}
+	}()
+	client.startPoller()
+
+	var r *callResult
+	select {
+	case r = <-result:
+	case <-ctx.Done():
+		if client.fail(requestID, ctx.Err()) {
+			go client.cancel(url, requestID)
+		}
+		r = <-result
+	}
+	if r.err != nil {
+		return url, nil, r.err
+	}
+	expected := authorizer.KindData
+	switch req.kind {
+	case authorizer.KindPing:
+		expected = authorizer.KindPong
+	case authorizer.KindHandshake:
+		expected = authorizer.KindHandshake
+	}
+	switch r.env.MessageKind() {
+	case expected:
+		if req.e2e != nil {
+			data, err := req.e2e.open(r.env, r.data)
+			return url, data, err
+		}
+		return url, r.data, nil
+
+	case authorizer.KindError:
+		return url, nil, &RemoteError{
+			Code:   r.env.Code,
+			Reason: r.env.Reason,
+		}
+
+	default:
+		return url, nil, fmt.Errorf("unexpected response kind '%s'",
+			r.env.Kind)
+	}
+}
+
+// cancel cancels the request so that the relay and the agent drop it
+// if they have not processed it yet.
+func (client *Client) cancel(url, requestID string) {
+	data, err := json.Marshal(&authorizer.CancelRequest{
+		ID: requestID,
+	})
 	if err != nil {
-		return nil, err
+		log.Printf("Cancel %s: %s\n", requestID, err)
+		return
+	}
+	status, data, err := client.http.do(context.Background(), "POST",
+		url+"/cancel", data, "")
+	if err == nil && status != http.StatusOK {
+		err = httpError(status, data)
+	}
+	if err != nil {
+		log.Printf("Cancel %s: %s\n", requestID, err)
 	}
+}
 
-	var get *http.Request
+// fail fails the pending call with the error. It returns false if
+// the call was not pending anymore.
+func (client *Client) fail(requestID string, err error) bool {
+	client.m.Lock()
+	result, ok := client.pending[requestID]
+	if ok {
+		delete(client.pending, requestID)
+	}
+	client.m.Unlock()
 
-	for {
-		resp, err := client.http.Do(req)
+	if ok {
+		result <- &callResult{
+			err: err,
+		}
+	}
+	return ok
+}
+
+// receive does the HTTP request and dispatches the response message
+// to its caller.
+func (client *Client) receive(ctx context.Context, method, url string,
+	body []byte, key string) error {
+
+	status, data, err := client.http.do(ctx, method, url, body, key)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK:
+		env := new(authorizer.Message)
+		err = json.Unmarshal(data, env)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		data, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+		client.dispatch(env)
+
+		// The response can belong to another call so it is
+		// acknowledged even if our context is done. If the ack
+		// fails, the relay redelivers the response and the
+		// duplicate is discarded.
+		err = ack(context.Background(), client.http, url, env)
 		if err != nil {
-			return nil, err
+			log.Printf("Ack failed: %s\n", err)
 		}
+		return nil
 
-		switch resp.StatusCode {
-		case http.StatusOK:
-			env := new(authorizer.Message)
-			err = json.Unmarshal(data, env)
-			if err != nil {
-				return nil, err
-			}
-			return env.Bytes()
+	case http.StatusAccepted, http.StatusRequestTimeout:
+		return nil
 
-		case http.StatusAccepted, http.StatusRequestTimeout:
-			if get == nil {
-				get, err = http.NewRequest("GET", client.url, nil)
-				if err != nil {
-					return nil, err
+	case http.StatusGone, http.StatusNotFound:
+		return ErrSessionExpired
+
+	case http.StatusServiceUnavailable:
+		return ErrAgentOffline
+
+	default:
+		return httpError(status, data)
+	}
+}
+
+// dispatch passes the response message to the pending call. Stale
+// responses are discarded.
+func (client *Client) dispatch(env *authorizer.Message) {
+	client.m.Lock()
+	result, ok := client.pending[env.ID]
+	if ok {
+		delete(client.pending, env.ID)
+	}
+	client.m.Unlock()
+
+	if !ok {
+		log.Printf("Discarding stale response %q\n", env.ID)
+		return
+	}
+	data, err := env.Bytes()
+	result <- &callResult{
+		env:  env,
+		data: data,
+		err:  err,
+	}
+}
+
+// startPoller starts the response poller if there are pending calls
+// and the poller is not already running.
+func (client *Client) startPoller() {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	if client.polling || len(client.pending) == 0 {
+		return
+	}
+	client.polling = true
+	go client.poll()
+}
+
+// poll receives responses until there are no pending calls. If the
+// receive fails, all pending calls fail with the error.
+func (client *Client) poll() {
+	for {
+		client.m.Lock()
+		if len(client.pending) == 0 {
+			client.polling = false
+			client.m.Unlock()
+			return
+		}
+		client.m.Unlock()
+
+		url, _, _ := client.session()
+		err := client.receive(context.Background(), "GET", url, nil, "")
+		if err != nil {
+			client.m.Lock()
+			for id, result := range client.pending {
+				result <- &callResult{
+					err: err,
 				}
+				delete(client.pending, id)
 			}
-			req = get
-
-		default:
-			return nil, httpError(resp.StatusCode, data)
+			client.polling = false
+			client.m.Unlock()
+			return
 		}
 	}
 }
+
+// Agents returns the agents registered to the relay.
+func (client *Client) Agents() ([]*authorizer.AgentInfo, error) {
+	return client.AgentsContext(context.Background())
+}
+
+// AgentsContext is like Agents but the context bounds the HTTP
+// request.
+func (client *Client) AgentsContext(ctx context.Context) (
+	[]*authorizer.AgentInfo, error) {
+
+	result := new(authorizer.AgentList)
+	err := client.get(ctx, client.baseURL+"/agents", result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Agents, nil
+}
+
+// AgentInfo returns information about the agent.
+func (client *Client) AgentInfo(id string) (*authorizer.AgentInfo, error) {
+	return client.AgentInfoContext(context.Background(), id)
+}
+
+// AgentInfoContext is like AgentInfo but the context bounds the HTTP
+// request.
+func (client *Client) AgentInfoContext(ctx context.Context, id string) (
+	*authorizer.AgentInfo, error) {
+
+	result := new(authorizer.AgentInfo)
+	err := client.get(ctx, client.baseURL+"/agents/"+id+"/info", result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (client *Client) get(ctx context.Context, url string,
+	v interface{}) error {
+
+	status, data, err := client.http.do(ctx, "GET", url, nil, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return httpError(status, data)
+	}
+	return json.Unmarshal(data, v)
+}
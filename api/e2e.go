@@ -0,0 +1,591 @@
+//
+// e2e.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/markkurossi/authorizer"
+	"github.com/markkurossi/authorizer/noise"
+	ssh "github.com/markkurossi/authorizer/secsh/agent"
+)
+
+// The end-to-end encryption protects the message payloads between
+// the client and the server so that the relay and its message broker
+// only see ciphertext. The client starts a session with each agent by
+// running a Noise IK handshake over the relay. The client learns the
+// agent's static public key from the relay and verifies it with its
+// AgentKeyCallback. The server authenticates the client's static key
+// with its authorization function. The agent ID, session ID, message
+// kind, request ID, channel, and deadline are authenticated as
+// additional data.
+//
+// The error responses are not authenticated. The relay creates some
+// of them itself, and a server that has forgotten the session no
+// longer has its keys for answering with ErrorUnknownSession. The
+// relay can therefore forge errors but it can only fail requests,
+// as it can by dropping them. A forged ErrorUnknownSession makes the
+// client run a new handshake, which authenticates the agent again,
+// and retry the request once, so the agent may process the request
+// twice.
+
+const (
+	// e2eSessionTTL specifies how long idle server sessions are
+	// remembered.
+	e2eSessionTTL = 24 * time.Hour
+
+	// e2eMaxSessions limits the number of server sessions.
+	e2eMaxSessions = 1024
+)
+
+// e2ePrologue returns the handshake prologue for the agent.
+func e2ePrologue(agentID string) []byte {
+	return []byte("authorizer-e2e-1\x00" + agentID)
+}
+
+// e2eAD returns the additional data of the message that is
+// encrypted in the agent's session. The deadline is authenticated so
+// that the relay cannot extend the lifetime of requests.
+func e2eAD(agentID string, msg *authorizer.Message) []byte {
+	var deadline string
+	if !msg.Deadline.IsZero() {
+		deadline = msg.Deadline.UTC().Format(time.RFC3339Nano)
+	}
+	var buf bytes.Buffer
+	for _, field := range []string{
+		agentID, msg.Session, string(msg.MessageKind()), msg.ID,
+		msg.Channel, deadline,
+	} {
+		buf.WriteString(field)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func newSessionID() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// clientSession implements the client's encrypted session with an
+// agent. The ready channel is closed when the session's handshake is
+// done. The session is usable if the handshake succeeded and set the
+// transport.
+type clientSession struct {
+	id        string
+	agent     string
+	ready     chan struct{}
+	transport *noise.Transport
+}
+
+// open decrypts the response message.
+func (s *clientSession) open(env *authorizer.Message, data []byte) (
+	[]byte, error) {
+
+	if env.Session != s.id {
+		return nil, fmt.Errorf("unencrypted response from agent %s", s.agent)
+	}
+	return s.transport.Open(e2eAD(s.agent, env), data)
+}
+
+// EnableEncryption enables the end-to-end encryption of the client's
+// requests. The static key pair identifies the client to the agents
+// and the verify callback checks the agents' public keys. When
+// encryption is enabled, the relay cannot route the requests by
+// their SSH agent keys and the client routes them itself.
+func (client *Client) EnableEncryption(static *noise.KeyPair,
+	verify AgentKeyCallback) {
+
+	client.e2eM.Lock()
+	defer client.e2eM.Unlock()
+
+	client.static = static
+	client.verifyKey = verify
+	client.sessions = make(map[string]*clientSession)
+	client.keyAgents = make(map[string]string)
+}
+
+func (client *Client) encrypted() bool {
+	client.e2eM.Lock()
+	defer client.e2eM.Unlock()
+	return client.static != nil
+}
+
+// e2eSession returns the encrypted session with the agent. New
+// sessions are established with a handshake. Concurrent callers wait
+// for the agent's handshake in progress without blocking the other
+// agents' sessions.
+func (client *Client) e2eSession(ctx context.Context, agentID string) (
+	*clientSession, error) {
+
+	for {
+		client.e2eM.Lock()
+		session, ok := client.sessions[agentID]
+		if !ok {
+			session = &clientSession{
+				agent: agentID,
+				ready: make(chan struct{}),
+			}
+			client.sessions[agentID] = session
+			client.e2eM.Unlock()
+
+			err := client.handshake(ctx, session)
+			if err != nil {
+				client.dropSession(session)
+			}
+			close(session.ready)
+			if err != nil {
+				return nil, err
+			}
+			return session, nil
+		}
+		client.e2eM.Unlock()
+
+		select {
+		case <-session.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if session.transport != nil {
+			return session, nil
+		}
+		// The other caller's handshake failed. Try again with our
+		// context.
+	}
+}
+
+// handshake does the handshake of the new session.
+func (client *Client) handshake(ctx context.Context,
+	session *clientSession) error {
+
+	agentID := session.agent
+
+	client.e2eM.Lock()
+	static := client.static
+	verify := client.verifyKey
+	client.e2eM.Unlock()
+
+	info, err := client.AgentInfoContext(ctx, agentID)
+	if err != nil {
+		return err
+	}
+	if len(info.PublicKey) != noise.KeyLen {
+		return fmt.Errorf("agent %s does not support encryption", agentID)
+	}
+	var key [noise.KeyLen]byte
+	copy(key[:], info.PublicKey)
+
+	if verify != nil {
+		err = verify(agentID, key)
+		if err != nil {
+			return fmt.Errorf("agent %s: %s", agentID, err)
+		}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	hs := noise.NewInitiator(static, key, e2ePrologue(agentID))
+	msg, err := hs.WriteMessage(nil)
+	if err != nil {
+		return err
+	}
+	msg, err = client.do(ctx, &request{
+		kind:    authorizer.KindHandshake,
+		agent:   agentID,
+		session: id,
+		payload: msg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = hs.ReadMessage(msg)
+	if err != nil {
+		return fmt.Errorf("agent %s handshake: %s", agentID, err)
+	}
+	transport, err := hs.Transport()
+	if err != nil {
+		return err
+	}
+	session.id = id
+	session.transport = transport
+
+	return nil
+}
+
+// dropSession forgets the agent's session.
+func (client *Client) dropSession(session *clientSession) {
+	client.e2eM.Lock()
+	defer client.e2eM.Unlock()
+
+	if client.sessions[session.agent] == session {
+		delete(client.sessions, session.agent)
+	}
+}
+
+// callAgent sends the encrypted request to the agent. If the agent
+// has forgotten the session, callAgent does a new handshake and
+// retries the request once.
+func (client *Client) callAgent(ctx context.Context, agentID,
+	channel string, msg []byte) ([]byte, error) {
+
+	for retry := false; ; retry = true {
+		session, err := client.e2eSession(ctx, agentID)
+		if err != nil {
+			return nil, err
+		}
+		data, err := client.do(ctx, &request{
+			kind:    authorizer.KindData,
+			agent:   agentID,
+			channel: channel,
+			e2e:     session,
+			payload: msg,
+		})
+		remote, ok := err.(*RemoteError)
+		if ok && remote.Code == authorizer.ErrorUnknownSession {
+			client.dropSession(session)
+			if !retry {
+				continue
+			}
+		}
+		return data, err
+	}
+}
+
+// callEncrypted routes the encrypted request to the session's
+// agents. The identities requests are answered with the merged
+// identities of all agents and the sign requests are passed to the
+// agent that holds the request's key.
+func (client *Client) callEncrypted(ctx context.Context, channel string,
+	msg []byte) ([]byte, error) {
+
+	client.m.Lock()
+	agents := client.agents
+	client.m.Unlock()
+
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("client not connected")
+	}
+	if len(agents) == 1 {
+		return client.callAgent(ctx, agents[0], channel, msg)
+	}
+	m, err := ssh.Wrap(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.Type() {
+	case ssh.SSH_AGENTC_REQUEST_IDENTITIES:
+		return client.identities(ctx, agents, channel, msg)
+
+	case ssh.SSH_AGENTC_SIGN_REQUEST:
+		req, err := ssh.ParseSignRequest(m)
+		if err != nil {
+			return nil, err
+		}
+		agentID, err := client.keyAgent(ctx, agents,
+			ssh.Fingerprint(req.KeyBlob))
+		if err != nil {
+			return nil, err
+		}
+		if len(agentID) == 0 {
+			// No agent has the key.
+			return ssh.NewMessage(ssh.SSH_AGENT_FAILURE, nil), nil
+		}
+		return client.callAgent(ctx, agentID, channel, msg)
+
+	default:
+		return client.callAgent(ctx, agents[0], channel, msg)
+	}
+}
+
+// identities answers the identities request with the merged
+// identities of the agents. Offline and failing agents are skipped.
+func (client *Client) identities(ctx context.Context, agents []string,
+	channel string, msg []byte) ([]byte, error) {
+
+	var ids []*ssh.Identity
+	for _, agentID := range agents {
+		data, err := client.callAgent(ctx, agentID, channel, msg)
+		if err != nil {
+			var remote *RemoteError
+			if err == ErrAgentOffline || errors.As(err, &remote) {
+				log.Printf("Agent %s identities: %s\n", agentID, err)
+				continue
+			}
+			return nil, err
+		}
+		m, err := ssh.Wrap(data)
+		if err != nil {
+			return nil, err
+		}
+		agentIDs, err := ssh.ParseIdentitiesAnswer(m)
+		if err != nil {
+			return nil, err
+		}
+		client.e2eM.Lock()
+	identities:
+		for _, identity := range agentIDs {
+			client.keyAgents[identity.Fingerprint()] = agentID
+			for _, old := range ids {
+				if bytes.Equal(old.Blob, identity.Blob) {
+					continue identities
+				}
+			}
+			ids = append(ids, identity)
+		}
+		client.e2eM.Unlock()
+	}
+	return ssh.NewIdentitiesAnswer(ids), nil
+}
+
+// keyAgent returns the agent that holds the key. The agent is looked
+// up from the keys of the previous identities answers and from the
+// keys that the agents advertised to the relay. Online agents are
+// preferred. If no agent has the key, keyAgent returns an empty ID.
+func (client *Client) keyAgent(ctx context.Context, agents []string,
+	fingerprint string) (string, error) {
+
+	client.e2eM.Lock()
+	agentID, ok := client.keyAgents[fingerprint]
+	client.e2eM.Unlock()
+	if ok {
+		return agentID, nil
+	}
+
+	var offline string
+	for _, id := range agents {
+		info, err := client.AgentInfoContext(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		for _, fp := range info.Fingerprints {
+			if fp != fingerprint {
+				continue
+			}
+			if info.Online {
+				return id, nil
+			}
+			if len(offline) == 0 {
+				offline = id
+			}
+		}
+	}
+	return offline, nil
+}
+
+// serverSession implements the server's encrypted session with a
+// client.
+type serverSession struct {
+	transport *noise.Transport
+	lastUsed  time.Time
+	request   []byte
+	reply     []byte
+}
+
+// EnableEncryption enables the end-to-end encryption of the server's
+// requests. The static key pair identifies the server to the clients
+// and its public key is registered to the relay on Connect. The
+// authorized function checks the clients' public keys. The relay and
+// all its users can start handshakes so clients must be authorized by
+// their keys. If the function is nil, all clients are rejected. When
+// encryption is enabled, the server rejects unencrypted requests.
+func (server *Server) EnableEncryption(static *noise.KeyPair,
+	authorized func(key [noise.KeyLen]byte) bool) {
+
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	server.static = static
+	server.authorized = authorized
+	server.sessions = make(map[string]*serverSession)
+}
+
+// handshake processes the client's handshake message and replies
+// with the server's handshake message.
+func (server *Server) handshake(ctx context.Context,
+	msg *authorizer.Message) error {
+
+	server.m.Lock()
+	static := server.static
+	authorized := server.authorized
+	session, exists := server.sessions[msg.Session]
+	server.m.Unlock()
+
+	if static == nil {
+		return server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, "encryption not supported")
+	}
+	if len(msg.Session) == 0 {
+		return server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, "no session ID")
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, err.Error())
+	}
+	if exists {
+		if !bytes.Equal(data, session.request) {
+			return server.SendErrorContext(ctx, msg,
+				authorizer.ErrorInvalidRequest, "session exists")
+		}
+		// Redelivered or retried handshake. The client did not
+		// necessarily receive our reply.
+		log.Printf("Resending handshake reply for session %s\n",
+			msg.Session)
+		return server.sendHandshake(ctx, msg, session.reply)
+	}
+	request := data
+	hs := noise.NewResponder(static, e2ePrologue(server.ID()))
+	_, err = hs.ReadMessage(data)
+	if err != nil {
+		return server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, "handshake failed")
+	}
+	remote := hs.RemoteStatic()
+	if authorized == nil || !authorized(remote) {
+		log.Printf("Rejecting unauthorized client key %s\n",
+			EncodeKey(remote))
+		return server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, "client key not authorized")
+	}
+	data, err = hs.WriteMessage(nil)
+	if err != nil {
+		return err
+	}
+	transport, err := hs.Transport()
+	if err != nil {
+		return err
+	}
+
+	server.m.Lock()
+	now := time.Now()
+	var oldest string
+	for id, session := range server.sessions {
+		if now.Sub(session.lastUsed) > e2eSessionTTL {
+			delete(server.sessions, id)
+		} else if len(oldest) == 0 ||
+			session.lastUsed.Before(server.sessions[oldest].lastUsed) {
+			oldest = id
+		}
+	}
+	if len(server.sessions) >= e2eMaxSessions {
+		delete(server.sessions, oldest)
+	}
+	server.sessions[msg.Session] = &serverSession{
+		transport: transport,
+		lastUsed:  now,
+		request:   request,
+		reply:     data,
+	}
+	server.m.Unlock()
+
+	log.Printf("New session %s for client key %s\n", msg.Session,
+		EncodeKey(remote))
+
+	return server.sendHandshake(ctx, msg, data)
+}
+
+// sendHandshake sends the handshake reply to the client.
+func (server *Server) sendHandshake(ctx context.Context,
+	msg *authorizer.Message, data []byte) error {
+
+	reply := &authorizer.Message{
+		Kind:    authorizer.KindHandshake,
+		ID:      msg.ID,
+		To:      msg.From,
+		Channel: msg.Channel,
+		Session: msg.Session,
+	}
+	reply.SetBytes(data)
+	return server.SendContext(ctx, reply)
+}
+
+// open decrypts the request message in place. It returns false if
+// the request was rejected and must not be processed.
+func (server *Server) open(ctx context.Context,
+	msg *authorizer.Message) (bool, error) {
+
+	server.m.Lock()
+	encrypted := server.static != nil
+	session, ok := server.sessions[msg.Session]
+	if ok {
+		session.lastUsed = time.Now()
+	}
+	server.m.Unlock()
+
+	if len(msg.Session) == 0 {
+		if encrypted {
+			return false, server.SendErrorContext(ctx, msg,
+				authorizer.ErrorInvalidRequest, "encryption required")
+		}
+		return true, nil
+	}
+	if !ok {
+		return false, server.SendErrorContext(ctx, msg,
+			authorizer.ErrorUnknownSession, "")
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return false, server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, err.Error())
+	}
+	data, err = session.transport.Open(e2eAD(server.ID(), msg), data)
+	if err == noise.ErrReplay {
+		log.Printf("Ignoring replayed request %s\n", msg.ID)
+		return false, nil
+	} else if err != nil {
+		return false, server.SendErrorContext(ctx, msg,
+			authorizer.ErrorInvalidRequest, "decryption failed")
+	}
+	msg.SetBytes(data)
+	return true, nil
+}
+
+// seal encrypts the response message if it belongs to an encrypted
+// session. Error responses are not encrypted.
+func (server *Server) seal(msg *authorizer.Message) (
+	*authorizer.Message, error) {
+
+	if len(msg.Session) == 0 || msg.MessageKind() != authorizer.KindData {
+		return msg, nil
+	}
+	server.m.Lock()
+	session, ok := server.sessions[msg.Session]
+	server.m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown session %s", msg.Session)
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	// The responses do not have deadlines.
+	sealed := *msg
+	sealed.Deadline = time.Time{}
+	data, err = session.transport.Seal(e2eAD(server.ID(), &sealed), data)
+	if err != nil {
+		return nil, err
+	}
+	sealed.SetBytes(data)
+	return &sealed, nil
+}
@@ -0,0 +1,199 @@
+//
+// keys.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/markkurossi/authorizer/noise"
+)
+
+var (
+	// ErrAgentKeyMismatch is returned when the agent's public key
+	// does not match its known key.
+	ErrAgentKeyMismatch = errors.New("agent public key mismatch")
+)
+
+// UnknownAgentError is returned by the KnownAgents callback when the
+// agent is not in the known agents file. The error message shows the
+// line that pins the agent's key.
+type UnknownAgentError struct {
+	AgentID string
+	Key     [noise.KeyLen]byte
+	Path    string
+}
+
+func (err *UnknownAgentError) Error() string {
+	return fmt.Sprintf("unknown agent, verify its public key and add "+
+		"the line \"%s %s\" to '%s'", err.AgentID, EncodeKey(err.Key),
+		err.Path)
+}
+
+// AgentKeyCallback verifies the agent's public key before the client
+// starts an end-to-end encrypted session with the agent. The keys are
+// received from the relay so the callback must check that the key
+// belongs to the agent.
+type AgentKeyCallback func(agentID string, key [noise.KeyLen]byte) error
+
+// ConfigPath returns the path of the named file in the user's
+// configuration directory.
+func ConfigPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(dir, "authorizer", name)
+}
+
+// EncodeKey encodes the public key in base64.
+func EncodeKey(key [noise.KeyLen]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// ParseKey parses the base64 encoded public key.
+func ParseKey(value string) ([noise.KeyLen]byte, error) {
+	var key [noise.KeyLen]byte
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return key, err
+	}
+	if len(data) != noise.KeyLen {
+		return key, fmt.Errorf("invalid key length %d", len(data))
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+// LoadKeyPair loads the static key pair from the file that holds the
+// base64 encoded private key. If the file does not exist, a new key
+// pair is created and saved to the file.
+func LoadKeyPair(path string) (*noise.KeyPair, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		private, err := ParseKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file '%s': %s", path, err)
+		}
+		return noise.NewKeyPair(private)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	kp, err := noise.GenerateKeyPair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, []byte(EncodeKey(kp.Private)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// KnownAgents returns an AgentKeyCallback that verifies the agent
+// keys against the known agents file. The file has one "agentID key"
+// line for each agent. New agents are refused with an
+// UnknownAgentError unless trustNew is set, in which case their keys
+// are trusted on first use and added to the file.
+func KnownAgents(path string, trustNew bool) AgentKeyCallback {
+	var m sync.Mutex
+
+	return func(agentID string, key [noise.KeyLen]byte) error {
+		m.Lock()
+		defer m.Unlock()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != agentID {
+				continue
+			}
+			known, err := ParseKey(fields[1])
+			if err != nil {
+				return fmt.Errorf("invalid key for agent %s in '%s': %s",
+					agentID, path, err)
+			}
+			if known != key {
+				return ErrAgentKeyMismatch
+			}
+			return nil
+		}
+		if !trustNew {
+			return &UnknownAgentError{
+				AgentID: agentID,
+				Key:     key,
+				Path:    path,
+			}
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0600)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(f, "%s %s\n", agentID, EncodeKey(key))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// LoadAuthorizedKeys loads the client public keys that are allowed
+// to start end-to-end encrypted sessions with a server. The file has
+// one base64 encoded key per line, optionally followed by a comment.
+// Empty lines and lines starting with '#' are ignored.
+func LoadAuthorizedKeys(path string) (func(key [noise.KeyLen]byte) bool,
+	error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[[noise.KeyLen]byte]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := ParseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		keys[key] = true
+	}
+	return func(key [noise.KeyLen]byte) bool {
+		return keys[key]
+	}, nil
+}
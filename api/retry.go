@@ -0,0 +1,170 @@
+//
+// retry.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+
+	"github.com/markkurossi/authorizer"
+)
+
+// RetryPolicy specifies how failed HTTP requests are retried.
+// Requests are retried on transport errors and on transient server
+// errors. The delay between attempts grows exponentially from
+// MinBackoff to MaxBackoff with random jitter.
+type RetryPolicy struct {
+	// MaxAttempts specifies the maximum number of attempts. Zero or
+	// negative value retries until the request succeeds.
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetryPolicy is the default retry policy of clients and
+// servers.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+}
+
+// backoff returns the delay before the attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxBackoff
+	if attempt < 32 {
+		d = p.MinBackoff << uint(attempt)
+		if d <= 0 || d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+	}
+	return d/2 + time.Duration(mathrand.Int63n(int64(d/2)+1))
+}
+
+// retryable tests if the HTTP status indicates a transient error.
+// Service unavailable is not retried since the relay uses it for
+// offline agents.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestTimeout bounds HTTP requests whose context has no deadline.
+// It is longer than the relay's long-poll timeouts.
+const requestTimeout = time.Minute
+
+// httpClient does HTTP requests with retries.
+// If the token source is set, the requests are authorized with its
+// bearer tokens.
+type httpClient struct {
+	client *http.Client
+	retry  RetryPolicy
+	tokens TokenSource
+}
+
+func newHTTPClient(tokens TokenSource) *httpClient {
+	return &httpClient{
+		client: &http.Client{
+			Timeout: requestTimeout,
+		},
+		retry:  DefaultRetryPolicy,
+		tokens: tokens,
+	}
+}
+
+// do does the HTTP request and returns the response status and body.
+// If the idempotency key is not empty, it is sent with the request.
+// The retries stop when the context is done.
+func (hc *httpClient) do(ctx context.Context, method, url string,
+	body []byte, key string) (int, []byte, error) {
+
+	for attempt := 0; ; attempt++ {
+		status, data, err := hc.doOnce(ctx, method, url, body, key)
+		if err == nil && !retryable(status) {
+			return status, data, nil
+		}
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if hc.retry.MaxAttempts > 0 && attempt+1 >= hc.retry.MaxAttempts {
+			return status, data, err
+		}
+		if err != nil {
+			log.Printf("%s %s failed, retrying: %s\n", method, url, err)
+		} else {
+			log.Printf("%s %s failed, retrying: %s\n", method, url,
+				httpError(status, data))
+		}
+		timer := time.NewTimer(hc.retry.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+func (hc *httpClient) doOnce(ctx context.Context, method, url string,
+	body []byte, key string) (int, []byte, error) {
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, method, url,
+			bytes.NewReader(body))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(key) > 0 {
+		req.Header.Set(authorizer.IdempotencyKeyHeader, key)
+	}
+	if hc.tokens != nil {
+		token, err := hc.tokens.Token(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// newIdempotencyKey creates a new random idempotency key.
+func newIdempotencyKey() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
@@ -9,44 +9,103 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/markkurossi/authorizer"
+	"github.com/markkurossi/authorizer/noise"
 )
 
 type Server struct {
-	http    *http.Client
+	http    *httpClient
 	baseURL string
-	url     string
+
+	m           sync.Mutex
+	done        chan struct{}
+	url         string
+	id          string
+	request     *authorizer.ServerConnectRequest
+	cancelled   map[string]time.Time
+	unavailable bool
+	changed     chan struct{}
+	static      *noise.KeyPair
+	authorized  func(key [noise.KeyLen]byte) bool
+	sessions    map[string]*serverSession
 }
 
-func NewServer(endpoint string) (*Server, error) {
+// NewServer creates a new server for the relay endpoint. If the token
+// source is not nil, the relay requests are authorized with its
+// tokens.
+func NewServer(endpoint string, tokens TokenSource) (*Server, error) {
 	return &Server{
-		http:    new(http.Client),
-		baseURL: canonizeEndpoint(endpoint),
+		http:      newHTTPClient(tokens),
+		baseURL:   canonizeEndpoint(endpoint),
+		cancelled: make(map[string]time.Time),
+		changed:   make(chan struct{}, 1),
 	}, nil
 }
 
-func (server *Server) Connect() error {
-	req, err := http.NewRequest("POST", server.baseURL+"/agents", nil)
+// SetRetryPolicy sets the retry policy of the server's HTTP requests.
+func (server *Server) SetRetryPolicy(policy RetryPolicy) {
+	server.http.retry = policy
+}
+
+// ID returns the agent ID of the server.
+func (server *Server) ID() string {
+	server.m.Lock()
+	defer server.m.Unlock()
+	return server.id
+}
+
+func (server *Server) getURL() string {
+	server.m.Lock()
+	defer server.m.Unlock()
+	return server.url
+}
+
+// Connect registers the server as an agent. If the request does not
+// specify an agent ID, the relay assigns a new ID for the server. If
+// the relay later forgets the agent, the server re-registers itself
+// with the same ID. If encryption is enabled, the server's public key
+// is registered with the agent.
+func (server *Server) Connect(agent *authorizer.ServerConnectRequest) error {
+	return server.ConnectContext(context.Background(), agent)
+}
+
+// ConnectContext is like Connect but the context bounds the HTTP
+// request.
+func (server *Server) ConnectContext(ctx context.Context,
+	agent *authorizer.ServerConnectRequest) error {
+
+	server.m.Lock()
+	if server.static != nil {
+		request := *agent
+		request.PublicKey = server.static.Public[:]
+		agent = &request
+	}
+	server.m.Unlock()
+
+	data, err := json.Marshal(agent)
 	if err != nil {
 		return err
 	}
-
-	resp, err := server.http.Do(req)
+	key, err := newIdempotencyKey()
 	if err != nil {
 		return err
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	status, data, err := server.http.do(ctx, "POST",
+		server.baseURL+"/agents", data, key)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return httpError(resp.StatusCode, data)
+	if status != http.StatusOK {
+		return httpError(status, data)
 	}
 
 	response := new(authorizer.ServerConnectResult)
@@ -54,68 +113,310 @@ func (server *Server) Connect() error {
 	if err != nil {
 		return err
 	}
+
+	server.m.Lock()
+	request := *agent
+	request.ID = response.ID
+	server.request = &request
 	server.url = server.baseURL + response.URL
+	server.id = response.ID
+	if server.done == nil {
+		server.done = make(chan struct{})
+		go server.heartbeat(server.done)
+	}
+	server.m.Unlock()
 
 	return nil
 }
 
-func (server *Server) Receive() (*authorizer.Message, error) {
-	req, err := http.NewRequest("GET", server.url, nil)
-	if err != nil {
-		return nil, err
+// reconnect re-registers the server after the relay has forgotten it.
+func (server *Server) reconnect(ctx context.Context) error {
+	server.m.Lock()
+	request := server.request
+	server.m.Unlock()
+
+	if request == nil {
+		return fmt.Errorf("server not connected")
 	}
+	log.Printf("Agent %s not found, reconnecting\n", request.ID)
+	return server.ConnectContext(ctx, request)
+}
+
+// Close stops the server's presence heartbeats.
+func (server *Server) Close() error {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	if server.done != nil {
+		close(server.done)
+		server.done = nil
+	}
+	return nil
+}
+
+// SetAvailable sets the availability of the server's local SSH
+// agent. The availability is reported to the relay with the presence
+// heartbeats. Changes are reported immediately.
+func (server *Server) SetAvailable(available bool) {
+	server.m.Lock()
+	changed := server.unavailable == available
+	server.unavailable = !available
+	server.m.Unlock()
+
+	if changed {
+		select {
+		case server.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// heartbeat announces the server's presence to the relay until the
+// done channel is closed. The receive long-polls also announce the
+// presence but heartbeats keep the agent online while the server is
+// busy processing requests.
+func (server *Server) heartbeat(done chan struct{}) {
+	ticker := time.NewTicker(authorizer.AgentPresenceTimeout / 3)
+	defer ticker.Stop()
 
 	for {
-		resp, err := server.http.Do(req)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-server.changed:
+		}
+		err := server.sendHeartbeat(context.Background())
 		if err != nil {
-			return nil, err
+			log.Printf("Heartbeat: %s\n", err)
 		}
-		data, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	}
+}
+
+func (server *Server) sendHeartbeat(ctx context.Context) error {
+	server.m.Lock()
+	agentStatus := &authorizer.AgentStatus{
+		Available: !server.unavailable,
+	}
+	server.m.Unlock()
+
+	data, err := json.Marshal(agentStatus)
+	if err != nil {
+		return err
+	}
+	status, data, err := server.http.do(ctx, "PUT", server.getURL(), data,
+		"")
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return server.reconnect(ctx)
+	default:
+		return httpError(status, data)
+	}
+}
+
+// Receive returns the next request message. Control messages and
+// encryption handshakes are processed internally and encrypted
+// requests are returned decrypted. If the relay has forgotten the
+// agent, Receive re-registers the server and continues receiving.
+// Requests of unsupported protocol versions are rejected with an
+// error response and reported with a VersionError.
+func (server *Server) Receive() (*authorizer.Message, error) {
+	return server.ReceiveContext(context.Background())
+}
+
+// ReceiveContext is like Receive but it returns the context's error
+// if the context is done before a request is received.
+func (server *Server) ReceiveContext(ctx context.Context) (
+	*authorizer.Message, error) {
+
+	for {
+		url := server.getURL()
+		status, data, err := server.http.do(ctx, "GET", url, nil, "")
 		if err != nil {
 			return nil, err
 		}
 
-		switch resp.StatusCode {
+		switch status {
 		case http.StatusOK:
 			msg := new(authorizer.Message)
 			err = json.Unmarshal(data, msg)
 			if err != nil {
 				return nil, err
 			}
-			return msg, nil
+			err = ack(ctx, server.http, url, msg)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			} else if err != nil {
+				// The relay redelivers the request.
+				log.Printf("Ack failed: %s\n", err)
+			}
+			if msg.Version > authorizer.ProtocolVersion {
+				err = server.SendErrorContext(ctx, msg,
+					authorizer.ErrorInvalidRequest,
+					"unsupported protocol version")
+				if err != nil {
+					log.Printf("Failed to reply to %s: %s\n", msg.ID, err)
+				}
+				return nil, &VersionError{
+					Version: msg.Version,
+				}
+			}
+			// Failed replies to the control messages are not fatal.
+			// The client times out or retries the request.
+			var replyErr error
+			switch msg.MessageKind() {
+			case authorizer.KindData:
+				var ok bool
+				ok, replyErr = server.open(ctx, msg)
+				if ok {
+					return msg, nil
+				}
+
+			case authorizer.KindHandshake:
+				replyErr = server.handshake(ctx, msg)
+
+			case authorizer.KindPing:
+				replyErr = server.SendContext(ctx, &authorizer.Message{
+					Kind:    authorizer.KindPong,
+					ID:      msg.ID,
+					To:      msg.From,
+					Channel: msg.Channel,
+				})
+
+			case authorizer.KindCancel:
+				server.cancel(msg)
+
+			case authorizer.KindClose:
+				server.close(msg)
+
+			default:
+				log.Printf("Ignoring message %s of kind '%s'\n", msg.ID,
+					msg.Kind)
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			} else if replyErr != nil {
+				log.Printf("Failed to reply to %s: %s\n", msg.ID, replyErr)
+			}
 
 		case http.StatusRequestTimeout:
 			// Retry
 
+		case http.StatusNotFound:
+			err = server.reconnect(ctx)
+			if err != nil {
+				return nil, err
+			}
+
 		default:
-			return nil, httpError(resp.StatusCode, data)
+			return nil, httpError(status, data)
 		}
 	}
 }
 
+// SendError sends an error response to the request.
+func (server *Server) SendError(req *authorizer.Message,
+	code authorizer.ErrorCode, reason string) error {
+
+	return server.SendErrorContext(context.Background(), req, code, reason)
+}
+
+// SendErrorContext is like SendError but the context bounds the HTTP
+// request.
+func (server *Server) SendErrorContext(ctx context.Context,
+	req *authorizer.Message, code authorizer.ErrorCode,
+	reason string) error {
+
+	return server.SendContext(ctx, &authorizer.Message{
+		Kind:    authorizer.KindError,
+		ID:      req.ID,
+		To:      req.From,
+		Channel: req.Channel,
+		Code:    code,
+		Reason:  reason,
+	})
+}
+
+// Send sends the message to its destination client. Responses to
+// encrypted requests are encrypted.
 func (server *Server) Send(msg *authorizer.Message) error {
-	data, err := json.Marshal(msg)
+	return server.SendContext(context.Background(), msg)
+}
+
+// SendContext is like Send but the context bounds the HTTP request.
+func (server *Server) SendContext(ctx context.Context,
+	msg *authorizer.Message) error {
+
+	msg.Version = authorizer.ProtocolVersion
+	msg, err := server.seal(msg)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", server.url, bytes.NewReader(data))
+	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-
-	resp, err := server.http.Do(req)
+	key, err := newIdempotencyKey()
 	if err != nil {
 		return err
 	}
-	data, err = ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	status, data, err := server.http.do(ctx, "POST", server.getURL(), data,
+		key)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return httpError(resp.StatusCode, data)
+	if status != http.StatusOK {
+		return httpError(status, data)
 	}
-
 	return nil
 }
+
+// cancelTTL specifies how long the cancelled request IDs are
+// remembered.
+const cancelTTL = 10 * time.Minute
+
+func cancelKey(msg *authorizer.Message) string {
+	return msg.From + "/" + msg.ID
+}
+
+// cancel records the request cancellation.
+func (server *Server) cancel(msg *authorizer.Message) {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	now := time.Now()
+	for key, t := range server.cancelled {
+		if now.Sub(t) > cancelTTL {
+			delete(server.cancelled, key)
+		}
+	}
+	server.cancelled[cancelKey(msg)] = now
+}
+
+// close forgets the cancelled requests of the closed client session.
+func (server *Server) close(msg *authorizer.Message) {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	prefix := msg.From + "/"
+	for key := range server.cancelled {
+		if strings.HasPrefix(key, prefix) {
+			delete(server.cancelled, key)
+		}
+	}
+}
+
+// Cancelled tests if the client has cancelled the request. Servers
+// check this before passing the request to the local agent.
+func (server *Server) Cancelled(msg *authorizer.Message) bool {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	_, ok := server.cancelled[cancelKey(msg)]
+	return ok
+}
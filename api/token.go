@@ -0,0 +1,153 @@
+//
+// token.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin specifies how long before their expiration the
+// cached tokens are refreshed.
+const tokenExpiryMargin = time.Minute
+
+// Token implements a bearer access token.
+type Token struct {
+	AccessToken string
+	// Expiry specifies when the token expires. Zero value means that
+	// the token does not expire.
+	Expiry time.Time
+}
+
+// Valid tests if the token is usable at the time now.
+func (t *Token) Valid(now time.Time) bool {
+	if t == nil || len(t.AccessToken) == 0 {
+		return false
+	}
+	return t.Expiry.IsZero() || now.Add(tokenExpiryMargin).Before(t.Expiry)
+}
+
+// TokenSource provides the access tokens for the relay requests.
+type TokenSource interface {
+	// Token returns a valid access token.
+	Token(ctx context.Context) (*Token, error)
+}
+
+// NewTokenSource returns the token source for a static token or a
+// token file. It returns nil if neither is specified and an error if
+// both are specified.
+func NewTokenSource(token, file string) (TokenSource, error) {
+	if len(token) > 0 && len(file) > 0 {
+		return nil, errors.New("both token and token file specified")
+	}
+	if len(token) > 0 {
+		return StaticTokenSource(token), nil
+	}
+	if len(file) > 0 {
+		return FileTokenSource(file), nil
+	}
+	return nil, nil
+}
+
+// StaticTokenSource returns a token source that always returns the
+// token.
+func StaticTokenSource(token string) TokenSource {
+	return &staticTokenSource{
+		token: &Token{
+			AccessToken: token,
+		},
+	}
+}
+
+type staticTokenSource struct {
+	token *Token
+}
+
+func (s *staticTokenSource) Token(ctx context.Context) (*Token, error) {
+	return s.token, nil
+}
+
+// FileTokenSource returns a token source that reads the token from
+// the file. The file is read again when it is modified so the token
+// can be rotated without restarting the program.
+func FileTokenSource(path string) TokenSource {
+	return &fileTokenSource{
+		path: path,
+	}
+}
+
+type fileTokenSource struct {
+	path    string
+	m       sync.Mutex
+	modTime time.Time
+	token   *Token
+}
+
+func (s *fileTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != nil && fi.ModTime().Equal(s.modTime) {
+		return s.token, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) == 0 {
+		return nil, errors.New("empty token file " + s.path)
+	}
+	s.modTime = fi.ModTime()
+	s.token = &Token{
+		AccessToken: token,
+	}
+	return s.token, nil
+}
+
+// RefreshingTokenSource returns a token source that caches the token
+// from the refresh function and calls the function again when the
+// token is about to expire.
+func RefreshingTokenSource(
+	refresh func(ctx context.Context) (*Token, error)) TokenSource {
+
+	return &refreshingTokenSource{
+		refresh: refresh,
+	}
+}
+
+type refreshingTokenSource struct {
+	refresh func(ctx context.Context) (*Token, error)
+	m       sync.Mutex
+	token   *Token
+}
+
+func (s *refreshingTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.token.Valid(time.Now()) {
+		return s.token, nil
+	}
+	token, err := s.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
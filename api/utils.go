@@ -9,8 +9,14 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
 	"strings"
+
+	"github.com/markkurossi/authorizer"
 )
 
 func canonizeEndpoint(endpoint string) string {
@@ -26,3 +32,34 @@ func httpError(code int, data []byte) error {
 	}
 	return fmt.Errorf("%d: %s", code, string(data))
 }
+
+// ack acknowledges the received message to the queue URL. The relay
+// redelivers messages that are not acknowledged. An expired lease is
+// not an error: either a retried ack has already succeeded or the
+// message is redelivered and its duplicate is discarded.
+func ack(ctx context.Context, client *httpClient, url string,
+	msg *authorizer.Message) error {
+
+	if len(msg.AckID) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(&authorizer.AckRequest{
+		AckID: msg.AckID,
+	})
+	if err != nil {
+		return err
+	}
+	status, data, err := client.do(ctx, "POST", url+"/ack", data, "")
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		log.Printf("Ack %s: lease expired\n", msg.AckID)
+		return nil
+	default:
+		return httpError(status, data)
+	}
+}
@@ -9,7 +9,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -19,18 +19,32 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/markkurossi/authorizer"
 	"github.com/markkurossi/authorizer/api"
 	"github.com/markkurossi/authorizer/secsh/agent"
 )
 
-var connections = make(map[string]*api.Client)
-
 func main() {
 	bindAddress := flag.String("a", "", "Unix-domain socket bind address")
 	endpoint := flag.String("u", "", "Authorizer endpoint URL")
+	agentIDs := flag.String("n", "", "Remote agent IDs (comma-separated)")
 	benchmark := flag.Bool("b", false, "Benchmark server")
+	list := flag.Bool("l", false, "List remote agents")
+	timeout := flag.Duration("timeout", 2*time.Minute, "Request timeout")
+	token := flag.String("t", "", "Relay access token")
+	tokenFile := flag.String("token-file", "",
+		"File containing relay access token, re-read when modified")
+	keyFile := flag.String("key", api.ConfigPath("agent.key"),
+		"Encryption key file, created if missing")
+	knownAgents := flag.String("known-agents",
+		api.ConfigPath("known_agents"), "File containing agent public keys")
+	trustNew := flag.Bool("trust-new-agents", false,
+		"Trust the public keys of new agents on first use")
+	plaintext := flag.Bool("plaintext", false,
+		"Disable end-to-end encryption")
 	flag.Parse()
 
 	if len(*bindAddress) == 0 {
@@ -44,14 +58,37 @@ func main() {
 		fmt.Printf("No authorizer URL specified\n")
 		os.Exit(1)
 	}
+	tokens, err := api.NewTokenSource(*token, *tokenFile)
+	if err != nil {
+		fmt.Printf("Invalid -t or -token-file: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *list {
+		err := listAgents(*endpoint, tokens)
+		if err != nil {
+			log.Fatalf("listAgents: %s\n", err)
+		}
+		return
+	}
+	var agents []string
+	if len(*agentIDs) == 0 {
+		id, err := selectAgent(*endpoint, tokens)
+		if err != nil {
+			log.Fatalf("selectAgent: %s\n", err)
+		}
+		agents = append(agents, id)
+	} else {
+		agents = strings.Split(*agentIDs, ",")
+	}
 
 	if *benchmark {
-		client, err := api.NewClient(*endpoint)
+		client, err := api.NewClient(*endpoint, tokens)
 		if err != nil {
 			log.Fatalf("api.NewClient: %s\n", err)
 		}
 
-		err = runBenchmark(client)
+		err = runBenchmark(client, agents)
 		client.Disconnect()
 
 		if err != nil {
@@ -60,6 +97,26 @@ func main() {
 		return
 	}
 
+	// All agent connections are multiplexed over one relay client.
+	client, err := api.NewClient(*endpoint, tokens)
+	if err != nil {
+		log.Fatalf("api.NewClient: %s\n", err)
+	}
+	if !*plaintext {
+		kp, err := api.LoadKeyPair(*keyFile)
+		if err != nil {
+			log.Fatalf("LoadKeyPair: %s\n", err)
+		}
+		client.EnableEncryption(kp,
+			api.KnownAgents(*knownAgents, *trustNew))
+		log.Printf("Public key %s\n", api.EncodeKey(kp.Public))
+	}
+	log.Printf("Connecting to server\n")
+	err = client.Connect(agents...)
+	if err != nil {
+		log.Fatalf("Connect: %s\n", err)
+	}
+
 	os.RemoveAll(*bindAddress)
 
 	listener, err := net.Listen("unix", *bindAddress)
@@ -75,14 +132,12 @@ func main() {
 	go func() {
 		s := <-c
 		fmt.Println("signal", s)
-		for k, c := range connections {
-			fmt.Printf("%s...", k)
-			err = c.Disconnect()
-			if err != nil {
-				fmt.Printf("%s\n", err)
-			} else {
-				fmt.Println()
-			}
+		fmt.Printf("%s...", client.ID())
+		err := client.Disconnect()
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		} else {
+			fmt.Println()
 		}
 		os.Exit(0)
 	}()
@@ -92,46 +147,131 @@ func main() {
 		if err != nil {
 			log.Fatalf("Accept: %s\n", err)
 		}
-		log.Printf("New connections\n")
+		ch := client.NewChannel()
+		log.Printf("New connection, channel %s\n", ch.ID())
 		go func(c net.Conn) {
-			err := handleConnection(c, *endpoint)
+			err := handleConnection(c, ch, *timeout)
 			if err != nil && err != io.EOF {
 				log.Printf("Connection error: %s\n", err)
 			}
+			c.Close()
 		}(conn)
 	}
 }
 
-func handleConnection(conn net.Conn, url string) error {
-	client, err := api.NewClient(url)
+func listAgents(url string, tokens api.TokenSource) error {
+	client, err := api.NewClient(url, tokens)
 	if err != nil {
 		return err
 	}
-
-	log.Printf("Connecting to server\n")
-	err = client.Connect()
+	agents, err := client.Agents()
 	if err != nil {
 		return err
 	}
-	connections[client.ID()] = client
-	defer func() {
-		delete(connections, client.ID())
-		err = client.Disconnect()
-		if err != nil {
-			fmt.Printf("%s: %s\n", client.ID(), err)
+	for _, a := range agents {
+		printAgent(a)
+	}
+	return nil
+}
+
+func printAgent(a *authorizer.AgentInfo) {
+	status := "offline"
+	if a.Online && a.Available {
+		status = "online"
+	} else if a.Online {
+		status = "online, agent unavailable"
+	}
+	fmt.Printf("%s\t%s\t%s\t%s, last seen %s\n", a.ID, a.Name, a.Owner,
+		status, a.LastSeen.Format(time.RFC3339))
+	for _, fp := range a.Fingerprints {
+		fmt.Printf("\t%s\n", fp)
+	}
+}
+
+// selectAgent prompts the user to select the remote agent.
+func selectAgent(url string, tokens api.TokenSource) (string, error) {
+	client, err := api.NewClient(url, tokens)
+	if err != nil {
+		return "", err
+	}
+	agents, err := client.Agents()
+	if err != nil {
+		return "", err
+	}
+	switch len(agents) {
+	case 0:
+		return "", fmt.Errorf("No remote agents registered")
+	case 1:
+		return agents[0].ID, nil
+	}
+	for idx, a := range agents {
+		fmt.Printf("%d) ", idx+1)
+		printAgent(a)
+	}
+	for {
+		fmt.Printf("Select agent: ")
+		var n int
+		_, err = fmt.Scanln(&n)
+		if err == io.EOF {
+			return "", err
+		}
+		if err == nil && n >= 1 && n <= len(agents) {
+			return agents[n-1].ID, nil
+		}
+	}
+}
+
+func handleConnection(conn net.Conn, ch *api.Channel,
+	timeout time.Duration) error {
+
+	// The connection context is cancelled when the SSH client closes
+	// the connection. This cancels the request in flight.
+	connCtx, connCancel := context.WithCancel(context.Background())
+	defer connCancel()
+
+	requests := make(chan agent.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := agent.Read(conn)
+			if err != nil {
+				readErr <- err
+				connCancel()
+				return
+			}
+			select {
+			case requests <- req:
+			case <-connCtx.Done():
+				return
+			}
 		}
 	}()
 
-	log.Printf("Processing messages\n")
 	for {
-		req, err := agent.Read(conn)
-		if err != nil {
+		var req agent.Message
+		select {
+		case req = <-requests:
+		case err := <-readErr:
 			return err
 		}
-		log.Printf("<- %s\n", req)
+		log.Printf("%s <- %s\n", ch.ID(), req)
 
-		data, err := client.Call(req)
-		if err != nil {
+		ctx, cancel := context.WithTimeout(connCtx, timeout)
+		data, err := ch.CallContext(ctx, req)
+		cancel()
+		if err == context.Canceled {
+			log.Printf("%s: request cancelled\n", ch.ID())
+			return <-readErr
+		} else if err == api.ErrAgentOffline {
+			log.Printf("%s: remote agent offline\n", ch.ID())
+			data = agent.NewMessage(agent.SSH_AGENT_FAILURE, nil)
+		} else if err == context.DeadlineExceeded {
+			log.Printf("%s: request timed out\n", ch.ID())
+			data = agent.NewMessage(agent.SSH_AGENT_FAILURE, nil)
+		} else if remote, ok := err.(*api.RemoteError); ok {
+			log.Printf("%s: remote agent error: %s\n", ch.ID(), remote)
+			data = agent.NewMessage(agent.SSH_AGENT_FAILURE, nil)
+		} else if err != nil {
 			return err
 		}
 
@@ -139,7 +279,7 @@ func handleConnection(conn net.Conn, url string) error {
 		if err != nil {
 			return err
 		}
-		log.Printf("-> %s\n", resp)
+		log.Printf("%s -> %s\n", ch.ID(), resp)
 
 		_, err = conn.Write(resp)
 		if err != nil {
@@ -148,16 +288,14 @@ func handleConnection(conn net.Conn, url string) error {
 	}
 }
 
-func runBenchmark(client *api.Client) error {
+func runBenchmark(client *api.Client, agents []string) error {
 	log.Printf("Connecting to server\n")
-	err := client.Connect()
+	err := client.Connect(agents...)
 	if err != nil {
 		return err
 	}
 	defer client.Disconnect()
 
-	data := []byte{0, 0, 0, 1, 255}
-
 	log.Printf("Running benchmark\n")
 
 	var min, max, total time.Duration
@@ -165,17 +303,10 @@ func runBenchmark(client *api.Client) error {
 	iterations := 10
 
 	for i := 0; i < iterations; i++ {
-		start := time.Now()
-
-		resp, err := client.Call(data)
+		d, err := client.Ping()
 		if err != nil {
 			return err
 		}
-		if bytes.Compare(data, resp) != 0 {
-			return fmt.Errorf("Invalid response data")
-		}
-
-		d := time.Now().Sub(start)
 
 		total += d
 		if i == 0 || d < min {
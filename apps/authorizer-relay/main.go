@@ -0,0 +1,161 @@
+//
+// authorizer-relay.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/markkurossi/authorizer"
+	"github.com/markkurossi/authorizer/authn"
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
+)
+
+func main() {
+	addr := flag.String("l", ":8080", "HTTP listen address")
+	method := flag.String("auth", "cloudsdk",
+		"Authentication method: cloudsdk, jwt, or apikey")
+	keyFile := flag.String("k", "", "Auth public key file (cloudsdk)")
+	key := flag.String("K", "", "Auth public key (cloudsdk, hex or base64)")
+	jwksFile := flag.String("jwks", "", "JWT signing keys JWKS file (jwt)")
+	issuer := flag.String("jwt-issuer", "", "Required JWT issuer (jwt)")
+	audience := flag.String("jwt-audience", "", "Required JWT audience (jwt)")
+	apiKeys := flag.String("api-keys", "", "API keys JSON file (apikey)")
+	dbFile := flag.String("db", "", "Message database file (default in-memory)")
+	stateFile := flag.String("state", "",
+		"Relay state database file (default in-memory)")
+	sweep := flag.Duration("sweep", 10*time.Minute,
+		"Interval for removing idle client sessions (0 disables)")
+	idle := flag.Duration("idle", authorizer.ClientIdleTimeout,
+		"Idle timeout for client sessions without a lease")
+	lease := flag.Duration("lease", authorizer.ClientLease,
+		"Lease duration of client sessions")
+	flag.Parse()
+
+	authenticator, err := authn.New(authn.Config{
+		Method:        *method,
+		Realm:         authorizer.REALM,
+		PublicKey:     *key,
+		PublicKeyFile: *keyFile,
+		JWT: authn.JWTConfig{
+			JWKSFile: *jwksFile,
+			Issuer:   *issuer,
+			Audience: *audience,
+		},
+		APIKeysFile: *apiKeys,
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+
+	var msgBroker broker.Broker
+	if len(*dbFile) > 0 {
+		msgBroker, err = broker.NewBolt(*dbFile)
+		if err != nil {
+			fmt.Printf("Could not open database '%s': %s\n", *dbFile, err)
+			os.Exit(1)
+		}
+	} else {
+		msgBroker = broker.NewMemory()
+	}
+
+	var relayStore store.Store
+	if len(*stateFile) > 0 {
+		relayStore, err = store.NewBolt(*stateFile)
+		if err != nil {
+			fmt.Printf("Could not open state database '%s': %s\n",
+				*stateFile, err)
+			os.Exit(1)
+		}
+	} else {
+		relayStore = store.NewMemory()
+	}
+
+	relay := authorizer.NewRelay(msgBroker, relayStore, authenticator)
+	err = relay.SetClientLease(*lease)
+	if err != nil {
+		fmt.Printf("Invalid lease: %s\n", err)
+		msgBroker.Close()
+		relayStore.Close()
+		os.Exit(1)
+	}
+
+	if *sweep > 0 {
+		go sweeper(relay, *sweep, *idle)
+	}
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: relay,
+	}
+	done := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		s := <-c
+		log.Printf("Received %s, shutting down\n", s)
+
+		// Long-polls are cancelled after the grace period.
+		ctx, cancel := context.WithTimeout(context.Background(),
+			shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			server.Close()
+		}
+		close(done)
+	}()
+
+	log.Printf("Listening on %s\n", *addr)
+	listenErr := server.ListenAndServe()
+	if listenErr == http.ErrServerClosed {
+		<-done
+	} else {
+		log.Printf("ListenAndServe: %s\n", listenErr)
+	}
+
+	err = msgBroker.Close()
+	if err != nil {
+		log.Printf("Failed to close broker: %s\n", err)
+	}
+	err = relayStore.Close()
+	if err != nil {
+		log.Printf("Failed to close store: %s\n", err)
+	}
+	if listenErr != http.ErrServerClosed {
+		os.Exit(1)
+	}
+}
+
+// shutdownTimeout specifies how long the relay waits for the active
+// requests to complete on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// sweeper removes idle client sessions periodically.
+func sweeper(relay *authorizer.Relay, interval, idle time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := relay.Sweep(context.Background(), idle)
+		if err != nil {
+			log.Printf("Sweep failed: %s\n", err)
+			continue
+		}
+		for _, id := range removed {
+			log.Printf("Removed idle client %s\n", id)
+		}
+	}
+}
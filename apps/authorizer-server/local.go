@@ -0,0 +1,137 @@
+//
+// local.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markkurossi/authorizer/api"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+var (
+	errBackoff = errors.New("agent unavailable, waiting to reconnect")
+)
+
+// localAgent connects to the local SSH agent. It tracks the agent's
+// availability and reports it to the relay. After connection
+// failures, it waits with exponential backoff before it tries to
+// reconnect.
+type localAgent struct {
+	server   *api.Server
+	path     string
+	pathFile string
+
+	m        sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+// socket returns the agent socket path. If the path file is set, the
+// path is read from the file for each connection so that an agent
+// restarted with a new socket path is found.
+func (la *localAgent) socket() (string, error) {
+	if len(la.pathFile) == 0 {
+		return la.path, nil
+	}
+	data, err := ioutil.ReadFile(la.pathFile)
+	if err != nil {
+		return "", err
+	}
+	path := strings.TrimSpace(string(data))
+	if len(path) == 0 {
+		return "", fmt.Errorf("no agent socket in '%s'", la.pathFile)
+	}
+	return path, nil
+}
+
+// dial connects to the local agent. During the backoff period, dial
+// fails without trying to connect.
+func (la *localAgent) dial() (net.Conn, error) {
+	la.m.Lock()
+	backoff := time.Now().Before(la.retryAt)
+	la.m.Unlock()
+	if backoff {
+		return nil, errBackoff
+	}
+
+	path, err := la.socket()
+	if err != nil {
+		la.failed(err)
+		return nil, err
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		la.failed(err)
+		return nil, err
+	}
+	la.succeeded()
+	return conn, nil
+}
+
+// failed marks the agent unavailable and starts the backoff period.
+func (la *localAgent) failed(err error) {
+	la.m.Lock()
+	defer la.m.Unlock()
+
+	if la.failures == 0 {
+		log.Printf("Agent unavailable: %s\n", err)
+	}
+	la.failures++
+
+	backoff := maxBackoff
+	if la.failures < 8 {
+		backoff = minBackoff << uint(la.failures-1)
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	// Add jitter so that the workers do not reconnect in lockstep.
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	la.retryAt = time.Now().Add(backoff)
+
+	la.server.SetAvailable(false)
+}
+
+// succeeded marks the agent available.
+func (la *localAgent) succeeded() {
+	la.m.Lock()
+	defer la.m.Unlock()
+
+	if la.failures > 0 {
+		log.Printf("Agent available\n")
+	}
+	la.failures = 0
+	la.retryAt = time.Time{}
+
+	la.server.SetAvailable(true)
+}
+
+// watch probes the agent periodically so that its availability is
+// known also when there are no requests.
+func (la *localAgent) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		conn, err := la.dial()
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
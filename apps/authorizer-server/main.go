@@ -14,7 +14,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"time"
 
+	"github.com/markkurossi/authorizer"
 	"github.com/markkurossi/authorizer/api"
 	"github.com/markkurossi/authorizer/secsh/agent"
 )
@@ -22,13 +24,31 @@ import (
 func main() {
 	endpoint := flag.String("u", "", "Authorizer endpoint URL")
 	sock := flag.String("a", "", "SSH Agent endpoint (default $SSH_AUTH_SOCK)")
+	agentID := flag.String("n", "", "Agent ID (default assigned by relay)")
+	name := flag.String("d", "", "Agent display name")
+	owner := flag.String("o", os.Getenv("USER"), "Agent owner")
+	concurrency := flag.Int("c", 4, "Number of concurrent requests")
+	sockFile := flag.String("f", "",
+		"File containing SSH Agent endpoint, re-read on reconnect")
+	probe := flag.Duration("p", 10*time.Second,
+		"Interval for checking SSH Agent availability (0 disables)")
+	token := flag.String("t", "", "Relay access token")
+	tokenFile := flag.String("token-file", "",
+		"File containing relay access token, re-read when modified")
+	keyFile := flag.String("key", api.ConfigPath("server.key"),
+		"Encryption key file, created if missing")
+	authorizedKeys := flag.String("authorized-keys",
+		api.ConfigPath("authorized_keys"),
+		"File containing the public keys of the authorized clients")
+	plaintext := flag.Bool("plaintext", false,
+		"Disable end-to-end encryption")
 	flag.Parse()
 
 	if len(*endpoint) == 0 {
 		fmt.Printf("No authorizer URL specified\n")
 		os.Exit(1)
 	}
-	if len(*sock) == 0 {
+	if len(*sock) == 0 && len(*sockFile) == 0 {
 		path := os.Getenv("SSH_AUTH_SOCK")
 		if len(path) == 0 {
 			fmt.Printf("No -a specified and SSH_AUTH_SOCK is unset\n")
@@ -36,66 +56,250 @@ func main() {
 		}
 		*sock = path
 	}
+	if *concurrency < 1 {
+		fmt.Printf("Invalid concurrency %d\n", *concurrency)
+		os.Exit(1)
+	}
 
-	conn, err := net.Dial("unix", *sock)
+	tokens, err := api.NewTokenSource(*token, *tokenFile)
 	if err != nil {
-		fmt.Printf("Could not connect to agent '%s': %s\n", *sock, err)
+		fmt.Printf("Invalid -t or -token-file: %s\n", err)
 		os.Exit(1)
 	}
-
-	server, err := api.NewServer(*endpoint)
+	server, err := api.NewServer(*endpoint, tokens)
 	if err != nil {
 		fmt.Printf("Failed to create API client: %s\n", err)
 		os.Exit(1)
 	}
+	// The server keeps retrying until the relay is reachable again.
+	server.SetRetryPolicy(api.RetryPolicy{
+		MinBackoff: api.DefaultRetryPolicy.MinBackoff,
+		MaxBackoff: time.Minute,
+	})
+	if !*plaintext {
+		kp, err := api.LoadKeyPair(*keyFile)
+		if err != nil {
+			fmt.Printf("Could not load encryption key: %s\n", err)
+			os.Exit(1)
+		}
+		// Anyone who can reach the relay could drive the local
+		// agent if the clients were not authorized by their keys.
+		authorized, err := api.LoadAuthorizedKeys(*authorizedKeys)
+		if err != nil {
+			fmt.Printf("Could not load authorized keys: %s\n", err)
+			fmt.Printf("Add the client keys to %s or use -plaintext\n",
+				*authorizedKeys)
+			os.Exit(1)
+		}
+		server.EnableEncryption(kp, authorized)
+		log.Printf("Public key %s\n", api.EncodeKey(kp.Public))
+	}
+	local := &localAgent{
+		server:   server,
+		path:     *sock,
+		pathFile: *sockFile,
+	}
+
+	conn, err := local.dial()
+	if err != nil {
+		fmt.Printf("Could not connect to agent: %s\n", err)
+		os.Exit(1)
+	}
+
+	ids, err := identities(conn)
+	if err != nil {
+		fmt.Printf("Could not list agent identities: %s\n", err)
+		os.Exit(1)
+	}
+	var advertised []*authorizer.Identity
+	for _, id := range ids {
+		log.Printf("Identity %s %s\n", id.Fingerprint(), id.Comment)
+		advertised = append(advertised, &authorizer.Identity{
+			Key:     id.Blob,
+			Comment: id.Comment,
+		})
+	}
 
-	err = server.Connect()
+	err = server.Connect(&authorizer.ServerConnectRequest{
+		ID:         *agentID,
+		Name:       *name,
+		Owner:      *owner,
+		Identities: advertised,
+	})
 	if err != nil {
 		fmt.Printf("Failed to connecto to server: %s\n", err)
 		os.Exit(1)
 	}
+	fmt.Printf("Agent ID: %s\n", server.ID())
+
+	// Each worker has its own connection to the agent.
+	conn.Close()
+
+	if *probe > 0 {
+		go local.watch(*probe)
+	}
+
+	sched := newScheduler()
+	for i := 0; i < *concurrency; i++ {
+		w := &worker{
+			server: server,
+			local:  local,
+		}
+		go func() {
+			for {
+				sess, msg := sched.next()
+				w.handle(msg)
+				sched.done(sess)
+			}
+		}()
+	}
 
+	// Receive errors are not fatal. The server backs off and keeps
+	// receiving until the relay accepts its requests again, for
+	// example after the access token has been rotated.
+	var backoff time.Duration
 	for {
 		msg, err := server.Receive()
-		if err != nil {
-			fmt.Printf("Receive error: %s\n", err)
-			// XXX server.Disconnect
-			os.Exit(1)
-		}
-		data, err := msg.Bytes()
-		if err != nil {
-			fmt.Printf("Invalid message: %v\n", msg)
+		if verr, ok := err.(*api.VersionError); ok {
+			// The request was rejected and the relay is reachable.
+			log.Printf("Receive: %s\n", verr)
 			continue
 		}
-		payload, err := agent.Wrap(data)
 		if err != nil {
-			fmt.Printf("Invalid SSH agent message: %v\n", err)
+			backoff *= 2
+			if backoff == 0 {
+				backoff = time.Second
+			} else if backoff > maxReceiveBackoff {
+				backoff = maxReceiveBackoff
+			}
+			log.Printf("Receive error, retrying in %s: %s\n", backoff, err)
+			time.Sleep(backoff)
 			continue
 		}
-		log.Printf("%s <- %s\n", msg.From, payload)
+		backoff = 0
+		sched.add(msg)
+	}
+}
 
-		msg.To = msg.From
+// maxReceiveBackoff specifies the maximum delay between failed
+// receives.
+const maxReceiveBackoff = time.Minute
 
-		if payload.Type() != 255 { // 255 is ping for benchmark
-			_, err = conn.Write(payload)
-			if err != nil {
-				fmt.Printf("Agent write failed: %s\n", err)
-				os.Exit(1)
-			}
-			resp, err := agent.Read(conn)
+// worker processes requests with its own agent connection.
+type worker struct {
+	server *api.Server
+	local  *localAgent
+	conn   net.Conn
+}
+
+// handle passes the request to the local agent and sends the agent's
+// response to the client.
+func (w *worker) handle(msg *authorizer.Message) {
+	data, err := msg.Bytes()
+	if err != nil {
+		fmt.Printf("Invalid message: %v\n", msg)
+		sendError(w.server, msg, authorizer.ErrorInvalidRequest, err)
+		return
+	}
+	payload, err := agent.Wrap(data)
+	if err != nil {
+		fmt.Printf("Invalid SSH agent message: %v\n", err)
+		sendError(w.server, msg, authorizer.ErrorInvalidRequest, err)
+		return
+	}
+	log.Printf("%s <- %s\n", msg.From, payload)
+
+	if msg.Expired(time.Now()) {
+		// The client has given up on the request.
+		log.Printf("Ignoring expired request %s\n", msg.ID)
+		return
+	}
+	if w.server.Cancelled(msg) {
+		log.Printf("Ignoring cancelled request %s\n", msg.ID)
+		return
+	}
+
+	resp, code, err := w.process(payload)
+	if err != nil {
+		fmt.Printf("Agent failed: %s\n", err)
+		sendError(w.server, msg, code, err)
+		return
+	}
+
+	// Reply to the sender. The response keeps the request ID so the
+	// client can match it with its request.
+	msg.To = msg.From
+	msg.AckID = ""
+	msg.SetBytes(resp)
+
+	log.Printf("%s -> %s\n", msg.To, resp)
+
+	err = w.server.Send(msg)
+	if err != nil {
+		fmt.Printf("Send error: %s\n", err)
+	}
+}
+
+// process passes the request to the local agent. If the worker's
+// connection has broken since the previous request, for example when
+// the agent has been restarted, the request is retried once with a
+// new connection.
+func (w *worker) process(req agent.Message) (
+	agent.Message, authorizer.ErrorCode, error) {
+
+	for retry := false; ; retry = true {
+		fresh := w.conn == nil
+		if fresh {
+			conn, err := w.local.dial()
 			if err != nil {
-				fmt.Printf("Agent read failed: %s\n", err)
-				os.Exit(1)
+				return nil, authorizer.ErrorAgentUnavailable, err
 			}
-			msg.SetBytes(resp)
-
-			log.Printf("%s -> %s\n", msg.To, resp)
+			w.conn = conn
 		}
-
-		err = server.Send(msg)
-		if err != nil {
-			fmt.Printf("Send error: %s\n", err)
-			os.Exit(1)
+		resp, err := process(w.conn, req)
+		if err == nil {
+			return resp, authorizer.ErrorUnknown, nil
 		}
+		w.conn.Close()
+		w.conn = nil
+		if fresh || retry {
+			w.local.failed(err)
+			return nil, authorizer.ErrorAgentFailure, err
+		}
+		log.Printf("Agent connection broken, reconnecting: %s\n", err)
+	}
+}
+
+// process passes the request to the local SSH agent and returns the
+// agent's response.
+func process(conn net.Conn, req agent.Message) (agent.Message, error) {
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	return agent.Read(conn)
+}
+
+// sendError reports the request failure to the client.
+func sendError(server *api.Server, msg *authorizer.Message,
+	code authorizer.ErrorCode, err error) {
+
+	err = server.SendError(msg, code, err.Error())
+	if err != nil {
+		fmt.Printf("Send error: %s\n", err)
+	}
+}
+
+// identities lists the identities of the local SSH agent.
+func identities(conn net.Conn) ([]*agent.Identity, error) {
+	_, err := conn.Write(agent.NewMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES,
+		nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := agent.Read(conn)
+	if err != nil {
+		return nil, err
 	}
+	return agent.ParseIdentitiesAnswer(resp)
 }
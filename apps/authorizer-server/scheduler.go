@@ -0,0 +1,134 @@
+//
+// scheduler.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"sync"
+
+	"github.com/markkurossi/authorizer"
+)
+
+// scheduler distributes requests to workers. The requests of a
+// session are processed one at a time in their arrival order. The
+// clients with pending requests are served in round-robin order so a
+// busy client cannot starve others.
+type scheduler struct {
+	m       sync.Mutex
+	c       *sync.Cond
+	clients map[string]*client
+	ready   []*client
+}
+
+// client holds the sessions of a client.
+type client struct {
+	id       string
+	sessions map[string]*session
+	ready    []*session
+}
+
+// session holds the pending requests of a client channel.
+type session struct {
+	client  *client
+	channel string
+	pending []*authorizer.Message
+	busy    bool
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		clients: make(map[string]*client),
+	}
+	s.c = sync.NewCond(&s.m)
+	return s
+}
+
+// add adds the request to its session's queue.
+func (s *scheduler) add(msg *authorizer.Message) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	c, ok := s.clients[msg.From]
+	if !ok {
+		c = &client{
+			id:       msg.From,
+			sessions: make(map[string]*session),
+		}
+		s.clients[msg.From] = c
+	}
+	sess, ok := c.sessions[msg.Channel]
+	if !ok {
+		sess = &session{
+			client:  c,
+			channel: msg.Channel,
+		}
+		c.sessions[msg.Channel] = sess
+	}
+	sess.pending = append(sess.pending, msg)
+	if !sess.busy && len(sess.pending) == 1 {
+		s.schedule(sess)
+	}
+}
+
+// schedule marks the session ready for processing. A worker is
+// woken when the client becomes ready. The worker taking the client's
+// session wakes the next worker if the client has more ready
+// sessions.
+func (s *scheduler) schedule(sess *session) {
+	c := sess.client
+	c.ready = append(c.ready, sess)
+	if len(c.ready) == 1 {
+		s.ready = append(s.ready, c)
+		s.c.Signal()
+	}
+}
+
+// next returns the next request to process. It blocks until a
+// request is available. The caller must call done when it has
+// processed the request.
+func (s *scheduler) next() (*session, *authorizer.Message) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for len(s.ready) == 0 {
+		s.c.Wait()
+	}
+	c := s.ready[0]
+	s.ready = s.ready[1:]
+
+	sess := c.ready[0]
+	c.ready = c.ready[1:]
+	if len(c.ready) > 0 {
+		// Wake another worker for the client's other ready sessions.
+		s.ready = append(s.ready, c)
+		s.c.Signal()
+	}
+
+	msg := sess.pending[0]
+	sess.pending = sess.pending[1:]
+	sess.busy = true
+
+	return sess, msg
+}
+
+// done marks the session's current request processed.
+func (s *scheduler) done(sess *session) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	sess.busy = false
+	if len(sess.pending) > 0 {
+		s.schedule(sess)
+		return
+	}
+	c := sess.client
+	delete(c.sessions, sess.channel)
+	if len(c.sessions) == 0 {
+		delete(s.clients, c.id)
+	}
+}
@@ -0,0 +1,156 @@
+//
+// scheduler_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/markkurossi/authorizer"
+)
+
+func addRequest(s *scheduler, from, channel, id string) {
+	s.add(&authorizer.Message{
+		ID:      id,
+		From:    from,
+		Channel: channel,
+	})
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s := newScheduler()
+	addRequest(s, "A", "1", "a1")
+	addRequest(s, "A", "1", "a2")
+	addRequest(s, "A", "2", "a3")
+	addRequest(s, "A", "3", "a4")
+	addRequest(s, "B", "1", "b1")
+
+	// The clients are served in round-robin order and a channel's
+	// second request waits until its first request is done.
+	expected := []string{"a1", "b1", "a3", "a4"}
+	var sessions []*session
+	for _, id := range expected {
+		sess, msg := s.next()
+		if msg.ID != id {
+			t.Fatalf("got request %s, expected %s", msg.ID, id)
+		}
+		sessions = append(sessions, sess)
+	}
+	for _, sess := range sessions {
+		s.done(sess)
+	}
+	sess, msg := s.next()
+	if msg.ID != "a2" {
+		t.Fatalf("got request %s, expected a2", msg.ID)
+	}
+	s.done(sess)
+	if len(s.clients) != 0 || len(s.ready) != 0 {
+		t.Errorf("scheduler not empty: %v %v", s.clients, s.ready)
+	}
+}
+
+// runWorkers starts the workers that pass the requests to handle.
+func runWorkers(s *scheduler, count int, handle func(*authorizer.Message)) {
+	for i := 0; i < count; i++ {
+		go func() {
+			for {
+				sess, msg := s.next()
+				handle(msg)
+				s.done(sess)
+			}
+		}()
+	}
+}
+
+func TestSchedulerParallelChannels(t *testing.T) {
+	s := newScheduler()
+	blocked := make(chan struct{})
+	processed := make(chan string, 4)
+
+	runWorkers(s, 4, func(msg *authorizer.Message) {
+		if msg.ID == "slow" {
+			<-blocked
+		}
+		processed <- msg.ID
+	})
+	defer close(blocked)
+
+	// The workers are idle when the requests arrive so all wakeups
+	// must come from the scheduler.
+	time.Sleep(10 * time.Millisecond)
+	addRequest(s, "A", "1", "slow")
+	addRequest(s, "A", "2", "fast1")
+	addRequest(s, "A", "3", "fast2")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-processed:
+			if id == "slow" {
+				t.Fatalf("slow request processed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client's channels blocked behind a slow request")
+		}
+	}
+}
+
+func TestSchedulerChannelOrder(t *testing.T) {
+	s := newScheduler()
+
+	var m sync.Mutex
+	active := make(map[string]bool)
+	order := make(map[string][]string)
+	var wg sync.WaitGroup
+
+	runWorkers(s, 4, func(msg *authorizer.Message) {
+		key := msg.From + "/" + msg.Channel
+		m.Lock()
+		if active[key] {
+			t.Errorf("concurrent requests in channel %s", key)
+		}
+		active[key] = true
+		m.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		m.Lock()
+		active[key] = false
+		order[key] = append(order[key], msg.ID)
+		m.Unlock()
+		wg.Done()
+	})
+
+	clients := []string{"A", "B"}
+	channels := []string{"1", "2", "3"}
+	const count = 10
+	for i := 0; i < count; i++ {
+		for _, c := range clients {
+			for _, ch := range channels {
+				wg.Add(1)
+				addRequest(s, c, ch, string(rune('a'+i)))
+			}
+		}
+	}
+	wg.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+	for key, ids := range order {
+		if len(ids) != count {
+			t.Errorf("channel %s: %d requests processed", key, len(ids))
+		}
+		for i, id := range ids {
+			if id != string(rune('a'+i)) {
+				t.Errorf("channel %s: order %v", key, ids)
+				break
+			}
+		}
+	}
+}
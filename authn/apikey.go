@@ -0,0 +1,89 @@
+//
+// apikey.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// APIKey defines a static API key and its principal.
+type APIKey struct {
+	Key     string   `json:"key"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+// APIKeys implements an Authenticator for static API keys. The keys
+// are sent as bearer tokens.
+type APIKeys struct {
+	realm string
+	keys  map[[sha256.Size]byte]*Principal
+}
+
+// NewAPIKeys creates a new authenticator for the API keys.
+func NewAPIKeys(realm string, keys []APIKey) (*APIKeys, error) {
+	a := &APIKeys{
+		realm: realm,
+		keys:  make(map[[sha256.Size]byte]*Principal),
+	}
+	for _, key := range keys {
+		if len(key.Key) == 0 || len(key.Subject) == 0 {
+			return nil, fmt.Errorf("API key without key or subject")
+		}
+		// The keys are indexed by their digests so the lookup time
+		// does not depend on the matching key prefix.
+		digest := sha256.Sum256([]byte(key.Key))
+		_, ok := a.keys[digest]
+		if ok {
+			return nil, fmt.Errorf("duplicate API key for subject %s",
+				key.Subject)
+		}
+		a.keys[digest] = &Principal{
+			Subject: key.Subject,
+			Scopes:  key.Scopes,
+		}
+	}
+	return a, nil
+}
+
+// LoadAPIKeys creates a new authenticator for the API keys in the
+// JSON file. The file contains an array of APIKey objects.
+func LoadAPIKeys(realm, path string) (*APIKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API keys file '%s': %s", path, err)
+	}
+	return NewAPIKeys(realm, keys)
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *APIKeys) Authenticate(w http.ResponseWriter,
+	r *http.Request) *Principal {
+
+	key := bearerToken(r)
+	if len(key) == 0 {
+		unauthorized(w, a.realm, "No API key")
+		return nil
+	}
+	principal, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		unauthorized(w, a.realm, "Invalid API key")
+		return nil
+	}
+	return principal
+}
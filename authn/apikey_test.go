@@ -0,0 +1,87 @@
+//
+// apikey_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	a, err := NewAPIKeys("test", []APIKey{
+		{
+			Key:     "key1",
+			Subject: "joe",
+			Scopes:  []string{"client:connect"},
+		},
+		{
+			Key:     "key2",
+			Subject: "agent",
+			Scopes:  []string{"agent:serve"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		auth    string
+		subject string
+		scope   string
+	}{
+		{"Bearer key1", "joe", "client:connect"},
+		{"bearer key2", "agent", "agent:serve"},
+		{"Bearer key3", "", ""},
+		{"Bearer key", "", ""},
+		{"Basic key1", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if len(test.auth) > 0 {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		principal := a.Authenticate(w, r)
+		if len(test.subject) == 0 {
+			if principal != nil {
+				t.Errorf("%q: accepted as %s", test.auth, principal.Subject)
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%q: unexpected status %d", test.auth, w.Code)
+			}
+			continue
+		}
+		if principal == nil {
+			t.Errorf("%q: rejected", test.auth)
+			continue
+		}
+		if principal.Subject != test.subject {
+			t.Errorf("%q: subject %s", test.auth, principal.Subject)
+		}
+		if !principal.HasScope(test.scope) {
+			t.Errorf("%q: scopes %v", test.auth, principal.Scopes)
+		}
+	}
+}
+
+func TestAPIKeysInvalid(t *testing.T) {
+	tests := [][]APIKey{
+		{{Key: "", Subject: "joe"}},
+		{{Key: "key", Subject: ""}},
+		{{Key: "key", Subject: "joe"}, {Key: "key", Subject: "other"}},
+	}
+	for idx, keys := range tests {
+		_, err := NewAPIKeys("test", keys)
+		if err == nil {
+			t.Errorf("test %d: invalid keys accepted", idx)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+//
+// authn.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+// Package authn implements the relay's request authentication.
+package authn
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Principal identifies an authenticated caller.
+type Principal struct {
+	// Subject identifies the caller. Relay clients and agents are
+	// owned by the subject that created them.
+	Subject string
+	// Scopes lists the scopes granted to the caller.
+	Scopes []string
+}
+
+// HasScope tests if the principal has the scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates HTTP requests.
+type Authenticator interface {
+	// Authenticate returns the principal of the request. If the
+	// request is not authenticated, Authenticate writes an error
+	// response and returns nil.
+	Authenticate(w http.ResponseWriter, r *http.Request) *Principal
+}
+
+// bearerToken returns the bearer token of the request. It returns an
+// empty string if the request does not have a bearer token.
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+
+	value := r.Header.Get("Authorization")
+	if len(value) <= len(prefix) ||
+		!strings.EqualFold(value[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(value[len(prefix):])
+}
+
+// unauthorized writes an authentication error response.
+func unauthorized(w http.ResponseWriter, realm, format string,
+	a ...interface{}) {
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	http.Error(w, fmt.Sprintf(format, a...), http.StatusUnauthorized)
+}
@@ -0,0 +1,50 @@
+//
+// cloudsdk.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"crypto/ed25519"
+	"net/http"
+
+	"github.com/markkurossi/cloudsdk/api/auth"
+)
+
+// CloudSDK implements an Authenticator for the cloudsdk access tokens
+// that are signed with an ed25519 key.
+type CloudSDK struct {
+	realm  string
+	pubkey ed25519.PublicKey
+}
+
+// NewCloudSDK creates a new authenticator that verifies the tokens
+// with the public key.
+func NewCloudSDK(realm string, pubkey ed25519.PublicKey) *CloudSDK {
+	return &CloudSDK{
+		realm:  realm,
+		pubkey: pubkey,
+	}
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *CloudSDK) Authenticate(w http.ResponseWriter,
+	r *http.Request) *Principal {
+
+	token := auth.Authorize(w, r, a.realm, a.verify, nil)
+	if token == nil {
+		return nil
+	}
+	return &Principal{
+		Subject: token.TenantID + "/" + token.ClientID,
+		Scopes:  token.Scope,
+	}
+}
+
+func (a *CloudSDK) verify(message, sig []byte) bool {
+	return ed25519.Verify(a.pubkey, message, sig)
+}
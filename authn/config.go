@@ -0,0 +1,130 @@
+//
+// config.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Config selects and configures the relay's authenticator.
+type Config struct {
+	// Method is the authentication method: cloudsdk (the default),
+	// jwt, or apikey.
+	Method string
+	// Realm is the authentication realm of the error responses.
+	Realm string
+
+	// PublicKey is the cloudsdk auth public key as hex or base64
+	// encoded text.
+	PublicKey string
+	// PublicKeyFile is the cloudsdk auth public key file.
+	PublicKeyFile string
+	// PublicKeyFunc returns the cloudsdk auth public key if neither
+	// PublicKey nor PublicKeyFile is specified.
+	PublicKeyFunc func() (ed25519.PublicKey, error)
+
+	// JWT configures the jwt method.
+	JWT JWTConfig
+
+	// APIKeysFile is the API keys file of the apikey method.
+	APIKeysFile string
+}
+
+// New creates the authenticator for the configuration.
+func New(config Config) (Authenticator, error) {
+	switch config.Method {
+	case "", "cloudsdk":
+		pubkey, err := config.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		return NewCloudSDK(config.Realm, pubkey), nil
+
+	case "jwt":
+		if len(config.JWT.JWKSFile) == 0 {
+			return nil, errors.New("No JWKS file specified")
+		}
+		a, err := NewJWT(config.Realm, config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+
+	case "apikey":
+		if len(config.APIKeysFile) == 0 {
+			return nil, errors.New("No API keys file specified")
+		}
+		a, err := LoadAPIKeys(config.Realm, config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown authentication method '%s'",
+			config.Method)
+	}
+}
+
+// publicKey returns the cloudsdk auth public key.
+func (config Config) publicKey() (ed25519.PublicKey, error) {
+	switch {
+	case len(config.PublicKey) > 0:
+		pubkey, err := parsePublicKey([]byte(config.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid auth public key: %s", err)
+		}
+		return pubkey, nil
+
+	case len(config.PublicKeyFile) > 0:
+		data, err := ioutil.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read auth public key: %s", err)
+		}
+		pubkey, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid auth public key file '%s': %s",
+				config.PublicKeyFile, err)
+		}
+		return pubkey, nil
+
+	case config.PublicKeyFunc != nil:
+		return config.PublicKeyFunc()
+
+	default:
+		return nil, errors.New("No auth public key specified")
+	}
+}
+
+// parsePublicKey parses an ed25519 public key. The key can be
+// specified as raw key bytes or as hex or base64 encoded text.
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(data), nil
+	}
+	text := string(bytes.TrimSpace(data))
+
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.New("unknown key encoding")
+		}
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,121 @@
+//
+// config_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pubkey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "auth.pub")
+	err = ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(pubkey)+"\n"),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKeys := filepath.Join(dir, "apikeys.json")
+	err = ioutil.WriteFile(apiKeys,
+		[]byte(`[{"key":"key1","subject":"joe"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestJWT(t, dir, newTestKeys(t))
+	jwks := filepath.Join(dir, "jwks.json")
+
+	funcKey := func() (ed25519.PublicKey, error) {
+		return pubkey, nil
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		pubkey bool
+	}{
+		{"default method", Config{PublicKeyFunc: funcKey}, true},
+		{"base64 key", Config{
+			Method:    "cloudsdk",
+			PublicKey: base64.StdEncoding.EncodeToString(pubkey),
+		}, true},
+		{"hex key", Config{
+			Method:    "cloudsdk",
+			PublicKey: hex.EncodeToString(pubkey),
+		}, true},
+		{"key file", Config{
+			Method:        "cloudsdk",
+			PublicKeyFile: keyFile,
+			PublicKeyFunc: func() (ed25519.PublicKey, error) {
+				return nil, nil
+			},
+		}, true},
+		{"jwt", Config{
+			Method: "jwt",
+			JWT:    JWTConfig{JWKSFile: jwks},
+		}, false},
+		{"apikey", Config{
+			Method:      "apikey",
+			APIKeysFile: apiKeys,
+		}, false},
+	}
+	for _, test := range tests {
+		a, err := New(test.config)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.pubkey {
+			continue
+		}
+		c, ok := a.(*CloudSDK)
+		if !ok {
+			t.Errorf("%s: authenticator %T", test.name, a)
+			continue
+		}
+		if !bytes.Equal(c.pubkey, pubkey) {
+			t.Errorf("%s: wrong public key", test.name)
+		}
+	}
+
+	invalid := []struct {
+		name   string
+		config Config
+	}{
+		{"no public key", Config{Method: "cloudsdk"}},
+		{"invalid public key", Config{PublicKey: "invalid"}},
+		{"short public key", Config{
+			PublicKey: hex.EncodeToString(pubkey[:20]),
+		}},
+		{"missing key file", Config{
+			PublicKeyFile: filepath.Join(dir, "missing"),
+		}},
+		{"no JWKS file", Config{Method: "jwt"}},
+		{"no API keys file", Config{Method: "apikey"}},
+		{"unknown method", Config{Method: "basic"}},
+	}
+	for _, test := range invalid {
+		_, err := New(test.config)
+		if err == nil {
+			t.Errorf("%s: authenticator created", test.name)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+//
+// jwt.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for RS256 and ES256
+	_ "crypto/sha512" // SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTLeeway specifies the allowed clock skew when validating the
+// token expiration and not-before times.
+const JWTLeeway = time.Minute
+
+// JWTConfig configures the JWT authenticator.
+type JWTConfig struct {
+	// JWKSFile is the JSON Web Key Set file of the token signing
+	// keys. The file is read again when it is modified so the keys
+	// can be rotated without restarting the relay.
+	JWKSFile string
+	// Issuer is the required token issuer. Empty value accepts all
+	// issuers.
+	Issuer string
+	// Audience is the required token audience. Empty value accepts
+	// all audiences.
+	Audience string
+}
+
+// JWT implements an Authenticator for JSON Web Tokens. The tokens
+// are verified with the keys of a local key set and the key is
+// selected by the token's key ID.
+type JWT struct {
+	realm   string
+	config  JWTConfig
+	m       sync.Mutex
+	modTime time.Time
+	keys    []*verificationKey
+}
+
+// NewJWT creates a new JWT authenticator.
+func NewJWT(realm string, config JWTConfig) (*JWT, error) {
+	a := &JWT{
+		realm:  realm,
+		config: config,
+	}
+	_, err := a.keySet()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// keySet returns the current verification keys.
+func (a *JWT) keySet() ([]*verificationKey, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	fi, err := os.Stat(a.config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	if a.keys != nil && fi.ModTime().Equal(a.modTime) {
+		return a.keys, nil
+	}
+	data, err := ioutil.ReadFile(a.config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS file '%s': %s",
+			a.config.JWKSFile, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature keys in JWKS file '%s'",
+			a.config.JWKSFile)
+	}
+	a.keys = keys
+	a.modTime = fi.ModTime()
+	return keys, nil
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *JWT) Authenticate(w http.ResponseWriter,
+	r *http.Request) *Principal {
+
+	token := bearerToken(r)
+	if len(token) == 0 {
+		unauthorized(w, a.realm, "No bearer token")
+		return nil
+	}
+	principal, err := a.verify(token, time.Now())
+	if err != nil {
+		unauthorized(w, a.realm, "Invalid token: %s", err)
+		return nil
+	}
+	return principal
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       json.RawMessage `json:"scp"`
+}
+
+// verify verifies the token and returns its principal.
+func (a *JWT) verify(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := new(jwtHeader)
+	err := decodeSegment(parts[0], header)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	keys, err := a.keySet()
+	if err != nil {
+		return nil, err
+	}
+	key, err := selectKey(keys, header)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]),
+		sig)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := new(jwtClaims)
+	err = decodeSegment(parts[1], claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expires == nil {
+		return nil, errors.New("no expiration time")
+	}
+	if now.Add(-JWTLeeway).After(time.Unix(*claims.Expires, 0)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil &&
+		now.Add(JWTLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if len(a.config.Issuer) > 0 && claims.Issuer != a.config.Issuer {
+		return nil, fmt.Errorf("invalid issuer '%s'", claims.Issuer)
+	}
+	if len(a.config.Audience) > 0 {
+		audience, err := stringOrList(claims.Audience)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audience: %s", err)
+		}
+		if !contains(audience, a.config.Audience) {
+			return nil, errors.New("invalid audience")
+		}
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("no subject")
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	scp, err := stringOrList(claims.Scp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scp: %s", err)
+	}
+	for _, s := range scp {
+		scopes = append(scopes, strings.Fields(s)...)
+	}
+
+	return &Principal{
+		Subject: claims.Subject,
+		Scopes:  scopes,
+	}, nil
+}
+
+// selectKey selects the verification key for the token. Tokens
+// without a key ID are accepted only if the key set has one key.
+func selectKey(keys []*verificationKey, header *jwtHeader) (
+	*verificationKey, error) {
+
+	if len(header.Kid) == 0 {
+		if len(keys) != 1 {
+			return nil, errors.New("no key ID")
+		}
+		return keys[0], nil
+	}
+	for _, key := range keys {
+		if key.kid != header.Kid {
+			continue
+		}
+		if len(key.alg) > 0 && key.alg != header.Alg {
+			return nil, fmt.Errorf("algorithm '%s' not allowed for key '%s'",
+				header.Alg, key.kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID '%s'", header.Kid)
+}
+
+// verifySignature verifies the JWS signature of the signed data.
+func verifySignature(alg string, key crypto.PublicKey, data,
+	sig []byte) error {
+
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm '%s' not allowed for RSA key", alg)
+		}
+		h := hash.New()
+		h.Write(data)
+		err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig)
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is defined for one curve.
+		var curve elliptic.Curve
+		switch alg {
+		case "ES256":
+			curve = elliptic.P256()
+		case "ES384":
+			curve = elliptic.P384()
+		case "ES512":
+			curve = elliptic.P521()
+		default:
+			return fmt.Errorf("algorithm '%s' not allowed for EC key", alg)
+		}
+		if pub.Curve != curve {
+			return fmt.Errorf("algorithm '%s' not allowed for curve %s",
+				alg, pub.Curve.Params().Name)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm '%s' not allowed for OKP key", alg)
+		}
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a JSON value that is a string or a list of
+// strings.
+func stringOrList(data json.RawMessage) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var value string
+	if json.Unmarshal(data, &value) == nil {
+		return []string{value}, nil
+	}
+	var values []string
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
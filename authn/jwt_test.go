@@ -0,0 +1,402 @@
+//
+// jwt_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func pad(data []byte, size int) []byte {
+	return append(make([]byte, size-len(data)), data...)
+}
+
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ec384   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{
+		rsa:     rk,
+		ec:      ek,
+		ec384:   ek384,
+		ed25519: edk,
+	}
+}
+
+// newTestJWT creates a JWT authenticator for the test keys. The RSA
+// key is restricted to RS256 with the JWK alg parameter. The JWKS
+// file is stored in the directory dir.
+func newTestJWT(t *testing.T, dir string, keys *testKeys) *JWT {
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"alg": "RS256",
+				"n":   b64(keys.rsa.N.Bytes()),
+				"e":   b64(big.NewInt(int64(keys.rsa.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   b64(pad(keys.ec.X.Bytes(), 32)),
+				"y":   b64(pad(keys.ec.Y.Bytes(), 32)),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec384",
+				"crv": "P-384",
+				"x":   b64(pad(keys.ec384.X.Bytes(), 48)),
+				"y":   b64(pad(keys.ec384.Y.Bytes(), 48)),
+			},
+			{
+				"kty": "OKP",
+				"kid": "ed25519",
+				"crv": "Ed25519",
+				"x":   b64(keys.ed25519.Public().(ed25519.PublicKey)),
+			},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewJWT("test", JWTConfig{
+		JWKSFile: path,
+		Issuer:   "issuer",
+		Audience: "audience",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// sign creates a signed token. The signature algorithm is selected
+// by the key type and the alg header can be set independently to
+// test algorithm confusion.
+func sign(t *testing.T, alg, kid string, key crypto.Signer,
+	claims map[string]interface{}) string {
+
+	header, err := json.Marshal(map[string]string{
+		"alg": alg,
+		"kid": kid,
+		"typ": "JWT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := b64(header) + "." + b64(payload)
+
+	hash := crypto.SHA256
+	switch {
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(data))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(pad(r.Bytes(), size), pad(s.Bytes(), size)...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(data))
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return data + "." + b64(sig)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "issuer",
+		"aud":   []string{"other", "audience"},
+		"sub":   "joe",
+		"exp":   now.Add(time.Hour).Unix(),
+		"scope": "client:connect agent:serve",
+	}
+}
+
+func TestJWTValid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	a := newTestJWT(t, dir, keys)
+	now := time.Now()
+
+	tests := []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{
+		{"RS256", "rsa", keys.rsa},
+		{"ES256", "ec", keys.ec},
+		{"ES384", "ec384", keys.ec384},
+		{"EdDSA", "ed25519", keys.ed25519},
+	}
+	for _, test := range tests {
+		token := sign(t, test.alg, test.kid, test.key, testClaims(now))
+		principal, err := a.verify(token, now)
+		if err != nil {
+			t.Fatalf("%s: %s", test.alg, err)
+		}
+		if principal.Subject != "joe" {
+			t.Errorf("%s: subject %s", test.alg, principal.Subject)
+		}
+		if !principal.HasScope("agent:serve") {
+			t.Errorf("%s: scopes %v", test.alg, principal.Scopes)
+		}
+	}
+}
+
+func TestJWTAlgorithm(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	a := newTestJWT(t, dir, keys)
+	now := time.Now()
+
+	header := b64([]byte(`{"alg":"none","kid":"ed25519"}`))
+	payload, err := json.Marshal(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := header + "." + b64(payload)
+
+	_, err = a.verify(data+".", now)
+	if err == nil {
+		t.Errorf("alg none accepted")
+	}
+
+	// HS256 keyed with the public key bytes.
+	header = b64([]byte(`{"alg":"HS256","kid":"ed25519"}`))
+	data = header + "." + b64(payload)
+	mac := hmac.New(sha256.New, keys.ed25519.Public().(ed25519.PublicKey))
+	mac.Write([]byte(data))
+	_, err = a.verify(data+"."+b64(mac.Sum(nil)), now)
+	if err == nil {
+		t.Errorf("alg HS256 accepted")
+	}
+
+	tests := []struct {
+		name string
+		alg  string
+		kid  string
+		key  crypto.Signer
+	}{
+		{"alg not allowed for key", "RS384", "rsa", keys.rsa},
+		{"RSA alg for EC key", "RS256", "ec", keys.ec},
+		{"EC alg for OKP key", "ES256", "ed25519", keys.ed25519},
+		{"wrong key", "ES256", "ec", mustECKey(t)},
+		{"ES256 with P-384 key", "ES256", "ec384", keys.ec384},
+		{"ES384 with P-256 key", "ES384", "ec", keys.ec},
+		{"unknown key ID", "RS256", "unknown", keys.rsa},
+		{"no key ID", "RS256", "", keys.rsa},
+	}
+	for _, test := range tests {
+		token := sign(t, test.alg, test.kid, test.key, testClaims(now))
+		_, err := a.verify(token, now)
+		if err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJWTLeeway(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	a := newTestJWT(t, dir, keys)
+	now := time.Now()
+	skew := JWTLeeway / 2
+
+	tests := []struct {
+		name  string
+		exp   time.Time
+		nbf   time.Time
+		valid bool
+	}{
+		{"expired within leeway", now.Add(-skew), time.Time{}, true},
+		{"expired", now.Add(-JWTLeeway - time.Second), time.Time{}, false},
+		{"not before within leeway", now.Add(time.Hour), now.Add(skew), true},
+		{"not valid yet", now.Add(time.Hour), now.Add(JWTLeeway + time.Second),
+			false},
+	}
+	for _, test := range tests {
+		claims := testClaims(now)
+		claims["exp"] = test.exp.Unix()
+		if !test.nbf.IsZero() {
+			claims["nbf"] = test.nbf.Unix()
+		}
+		_, err := a.verify(sign(t, "EdDSA", "ed25519", keys.ed25519, claims),
+			now)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+
+	claims := testClaims(now)
+	delete(claims, "exp")
+	_, err := a.verify(sign(t, "EdDSA", "ed25519", keys.ed25519, claims), now)
+	if err == nil {
+		t.Errorf("token without expiration time accepted")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	a := newTestJWT(t, dir, keys)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+	}{
+		{"issuer", "iss", "other"},
+		{"audience", "aud", "other"},
+		{"subject", "sub", ""},
+	}
+	for _, test := range tests {
+		claims := testClaims(now)
+		claims[test.claim] = test.value
+		_, err := a.verify(sign(t, "EdDSA", "ed25519", keys.ed25519, claims),
+			now)
+		if err == nil {
+			t.Errorf("invalid %s accepted", test.name)
+		}
+	}
+
+	token := sign(t, "EdDSA", "ed25519", keys.ed25519, testClaims(now))
+	parts := strings.Split(token, ".")
+	claims := testClaims(now)
+	claims["sub"] = "admin"
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.verify(parts[0]+"."+b64(payload)+"."+parts[2], now)
+	if err == nil {
+		t.Errorf("modified claims accepted")
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	a := newTestJWT(t, dir, keys)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if a.Authenticate(w, r) != nil {
+		t.Errorf("request without token accepted")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+
+	token := sign(t, "EdDSA", "ed25519", keys.ed25519,
+		testClaims(time.Now()))
+	r.Header.Set("Authorization", "Bearer "+token)
+	principal := a.Authenticate(httptest.NewRecorder(), r)
+	if principal == nil || principal.Subject != "joe" {
+		t.Errorf("valid token rejected")
+	}
+}
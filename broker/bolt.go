@@ -0,0 +1,391 @@
+//
+// bolt.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bo = binary.BigEndian
+
+	bucketQueues   = []byte("queues")
+	bucketMessages = []byte("messages")
+	keyLastUsed    = []byte("lastUsed")
+)
+
+// lastUsedResolution specifies how often the queue's last used time
+// is updated when it is polled. Receivers polling an empty queue do
+// not write to the database more often than this.
+const lastUsedResolution = time.Hour
+
+// Bolt implements a Broker that persists its queues in a bbolt
+// database file. Pending messages and unacknowledged leases survive
+// process restarts.
+type Bolt struct {
+	db     *bolt.DB
+	now    func() time.Time
+	m      sync.Mutex
+	notify map[string]chan struct{}
+}
+
+type boltMessage struct {
+	ID         string            `json:"id"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Delivery   uint64            `json:"delivery"`
+	Deadline   time.Time         `json:"deadline"`
+}
+
+// NewBolt opens the bbolt database file path, creating it if it does
+// not exist, and returns a broker that stores its queues in the
+// database.
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketQueues)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{
+		db:     db,
+		now:    time.Now,
+		notify: make(map[string]chan struct{}),
+	}, nil
+}
+
+// waiter returns a channel that is closed when the queue changes.
+func (b *Bolt) waiter(queue string) <-chan struct{} {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch, ok := b.notify[queue]
+	if !ok {
+		ch = make(chan struct{})
+		b.notify[queue] = ch
+	}
+	return ch
+}
+
+// wakeup wakes up all receivers waiting for the queue.
+func (b *Bolt) wakeup(queue string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch, ok := b.notify[queue]
+	if ok {
+		close(ch)
+		delete(b.notify, queue)
+	}
+}
+
+func lastUsed(qb *bolt.Bucket) time.Time {
+	val := qb.Get(keyLastUsed)
+	if len(val) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(bo.Uint64(val)))
+}
+
+func setLastUsed(qb *bolt.Bucket, now time.Time) error {
+	var buf [8]byte
+	bo.PutUint64(buf[:], uint64(now.UnixNano()))
+	return qb.Put(keyLastUsed, buf[:])
+}
+
+// queueBucket returns the bucket of the named queue. Expired queues
+// are deleted and reported as not found with a nil bucket so that the
+// deletion is committed.
+func queueBucket(tx *bolt.Tx, queue string, now time.Time) (
+	*bolt.Bucket, error) {
+
+	queues := tx.Bucket(bucketQueues)
+	qb := queues.Bucket([]byte(queue))
+	if qb == nil {
+		return nil, nil
+	}
+	if now.Sub(lastUsed(qb)) > Expiration {
+		return nil, queues.DeleteBucket([]byte(queue))
+	}
+	return qb, nil
+}
+
+// updateQueue calls the function in a read-write transaction with the
+// bucket of the named queue. It returns ErrQueueNotFound if the queue
+// does not exist or it has expired. The receivers of an expired
+// queue are woken up so that they notice the queue is gone.
+func (b *Bolt) updateQueue(queue string, now time.Time,
+	f func(tx *bolt.Tx, qb *bolt.Bucket) error) error {
+
+	var found bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		qb, err := queueBucket(tx, queue, now)
+		if err != nil || qb == nil {
+			return err
+		}
+		found = true
+		return f(tx, qb)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		b.wakeup(queue)
+		return ErrQueueNotFound
+	}
+	return nil
+}
+
+// nextMessage returns the key and the message of the first message
+// that is not leased to a receiver. If all messages are leased, it
+// returns the deadline of the earliest lease.
+func nextMessage(qb *bolt.Bucket, now time.Time) (
+	[]byte, *boltMessage, time.Time, error) {
+
+	var next time.Time
+	c := qb.Bucket(bucketMessages).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		msg := new(boltMessage)
+		err := json.Unmarshal(v, msg)
+		if err != nil {
+			return nil, nil, next, err
+		}
+		if now.Before(msg.Deadline) {
+			// Leased to another receiver.
+			if next.IsZero() || msg.Deadline.Before(next) {
+				next = msg.Deadline
+			}
+			continue
+		}
+		return k, msg, next, nil
+	}
+	return nil, nil, next, nil
+}
+
+// CreateQueue implements Broker.CreateQueue.
+func (b *Bolt) CreateQueue(ctx context.Context, queue string) error {
+	var expired []string
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		now := b.now()
+		queues := tx.Bucket(bucketQueues)
+
+		// Expire unused queues.
+		c := queues.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			if now.Sub(lastUsed(queues.Bucket(k))) > Expiration {
+				expired = append(expired, string(k))
+			}
+		}
+		for _, name := range expired {
+			err := queues.DeleteBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		qb, err := queues.CreateBucketIfNotExists([]byte(queue))
+		if err != nil {
+			return err
+		}
+		_, err = qb.CreateBucketIfNotExists(bucketMessages)
+		if err != nil {
+			return err
+		}
+		return setLastUsed(qb, now)
+	})
+	for _, name := range expired {
+		b.wakeup(name)
+	}
+	return err
+}
+
+// DeleteQueue implements Broker.DeleteQueue.
+func (b *Bolt) DeleteQueue(ctx context.Context, queue string) error {
+	err := b.updateQueue(queue, b.now(),
+		func(tx *bolt.Tx, qb *bolt.Bucket) error {
+			return tx.Bucket(bucketQueues).DeleteBucket([]byte(queue))
+		})
+	b.wakeup(queue)
+	return err
+}
+
+// Publish implements Broker.Publish.
+func (b *Bolt) Publish(ctx context.Context, queue string, msg *Message) error {
+	err := b.updateQueue(queue, b.now(),
+		func(tx *bolt.Tx, qb *bolt.Bucket) error {
+			msgs := qb.Bucket(bucketMessages)
+			seq, err := msgs.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(&boltMessage{
+				ID:         fmt.Sprintf("%d", seq),
+				Data:       msg.Data,
+				Attributes: msg.Attributes,
+			})
+			if err != nil {
+				return err
+			}
+			var key [8]byte
+			bo.PutUint64(key[:], seq)
+			return msgs.Put(key[:], data)
+		})
+	if err != nil {
+		return err
+	}
+	b.wakeup(queue)
+	return nil
+}
+
+// Receive implements Broker.Receive.
+func (b *Bolt) Receive(ctx context.Context, queue string) (*Message, error) {
+	for {
+		// Get the waiter before checking the queue so that we do
+		// not miss wakeups between the check and the wait.
+		notify := b.waiter(queue)
+
+		var result *Message
+		var next time.Time
+		var pending, stale bool
+		now := b.now()
+
+		// Check the queue in a read-only transaction so that polling
+		// an empty queue does not write to the database. Missing
+		// queues are reported by the read-write transaction below.
+		err := b.db.View(func(tx *bolt.Tx) error {
+			qb := tx.Bucket(bucketQueues).Bucket([]byte(queue))
+			if qb == nil {
+				stale = true
+				return nil
+			}
+			stale = now.Sub(lastUsed(qb)) > lastUsedResolution
+			k, _, deadline, err := nextMessage(qb, now)
+			pending = k != nil
+			next = deadline
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if pending || stale {
+			err = b.updateQueue(queue, now,
+				func(tx *bolt.Tx, qb *bolt.Bucket) error {
+					err := setLastUsed(qb, now)
+					if err != nil {
+						return err
+					}
+					k, msg, deadline, err := nextMessage(qb, now)
+					next = deadline
+					if err != nil || k == nil {
+						return err
+					}
+					msg.Delivery++
+					msg.Deadline = now.Add(AckDeadline)
+					data, err := json.Marshal(msg)
+					if err != nil {
+						return err
+					}
+					result = &Message{
+						ID:         msg.ID,
+						Data:       msg.Data,
+						Attributes: msg.Attributes,
+						AckID: fmt.Sprintf("%d.%d", bo.Uint64(k),
+							msg.Delivery),
+					}
+					return qb.Bucket(bucketMessages).Put(k, data)
+				})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if result != nil {
+			return result, nil
+		}
+
+		// Wait for new messages or for the next lease to expire.
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-notify:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+	}
+}
+
+// Ack implements Broker.Ack.
+func (b *Bolt) Ack(ctx context.Context, queue, ackID string) error {
+	var seq, delivery uint64
+
+	_, err := fmt.Sscanf(ackID, "%d.%d", &seq, &delivery)
+	if err != nil {
+		return ErrInvalidAckID
+	}
+	return b.updateQueue(queue, b.now(),
+		func(tx *bolt.Tx, qb *bolt.Bucket) error {
+			msgs := qb.Bucket(bucketMessages)
+
+			var key [8]byte
+			bo.PutUint64(key[:], seq)
+			data := msgs.Get(key[:])
+			if data == nil {
+				return ErrInvalidAckID
+			}
+			msg := new(boltMessage)
+			err = json.Unmarshal(data, msg)
+			if err != nil {
+				return err
+			}
+			if msg.Delivery != delivery {
+				return ErrInvalidAckID
+			}
+			return msgs.Delete(key[:])
+		})
+}
+
+// Close implements Broker.Close.
+func (b *Bolt) Close() error {
+	b.m.Lock()
+	for queue, ch := range b.notify {
+		close(ch)
+		delete(b.notify, queue)
+	}
+	b.m.Unlock()
+
+	return b.db.Close()
+}
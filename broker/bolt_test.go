@@ -0,0 +1,150 @@
+//
+// bolt_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openBolt(t *testing.T, dir string, clock *testClock) *Bolt {
+	b, err := NewBolt(filepath.Join(dir, "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = clock.Now
+	return b
+}
+
+func TestBoltPersistence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	clock := newTestClock()
+	ctx := context.Background()
+
+	b := openBolt(t, dir, clock)
+	err := b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPublish(t, b, "q", "first")
+	mustPublish(t, b, "q", "second")
+	leased := mustReceive(t, b, "q")
+	if string(leased.Data) != "first" {
+		t.Fatalf("received %q", leased.Data)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending message and the lease survive the restart.
+	b = openBolt(t, dir, clock)
+	defer b.Close()
+
+	msg := mustReceive(t, b, "q")
+	if string(msg.Data) != "second" {
+		t.Fatalf("received %q", msg.Data)
+	}
+	err = b.Ack(ctx, "q", leased.AckID)
+	if err != nil {
+		t.Fatalf("Ack after restart: %s", err)
+	}
+	err = b.Ack(ctx, "q", msg.AckID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(AckDeadline + time.Second)
+	msg, err = receive(t, b, "q", 50*time.Millisecond)
+	if err != nil || msg != nil {
+		t.Fatalf("acked message redelivered: %v %v", msg, err)
+	}
+}
+
+func TestBoltBroker(t *testing.T) {
+	testBroker(t, func(t *testing.T, clock *testClock) (Broker, func()) {
+		dir := tempDir(t)
+		b := openBolt(t, dir, clock)
+		return b, func() {
+			b.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestBoltLastUsed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	clock := newTestClock()
+	ctx := context.Background()
+
+	b := openBolt(t, dir, clock)
+	defer b.Close()
+
+	err := b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := clock.Now()
+
+	getLastUsed := func() time.Time {
+		var result time.Time
+		err := b.db.View(func(tx *bolt.Tx) error {
+			result = lastUsed(tx.Bucket(bucketQueues).Bucket([]byte("q")))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Polling an empty queue does not update the last used time
+	// until it is stale.
+	clock.Advance(time.Minute)
+	_, err = receive(t, b, "q", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !getLastUsed().Equal(created) {
+		t.Errorf("last used time updated by poll")
+	}
+
+	clock.Advance(lastUsedResolution)
+	_, err = receive(t, b, "q", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !getLastUsed().Equal(clock.Now()) {
+		t.Errorf("stale last used time not updated")
+	}
+
+	// Polling keeps the queue alive.
+	for i := 0; i < 30; i++ {
+		clock.Advance(lastUsedResolution)
+		_, err = receive(t, b, "q", time.Millisecond)
+		if err != nil {
+			t.Fatalf("Receive after %d hours: %s", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+//
+// broker.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// AckDeadline specifies how long a received message is leased to
+	// its receiver. If the message is not acknowledged before the
+	// deadline, it is redelivered.
+	AckDeadline = 10 * time.Second
+
+	// Expiration specifies how long an unused queue is kept before it
+	// is deleted.
+	Expiration = 25 * time.Hour
+)
+
+var (
+	// ErrInvalidAckID is returned by Ack if the ack ID is unknown
+	// or if its lease has expired and the message has been
+	// redelivered.
+	ErrInvalidAckID = errors.New("invalid ack ID")
+
+	// ErrQueueNotFound is returned when the named queue does not
+	// exist or if it has expired.
+	ErrQueueNotFound = errors.New("queue not found")
+)
+
+// Message implements a queue message.
+type Message struct {
+	ID         string
+	Data       []byte
+	Attributes map[string]string
+
+	// AckID identifies the delivery of a received message. It is
+	// passed to Ack to acknowledge the message.
+	AckID string
+}
+
+// Broker implements named message queues for the relay.
+type Broker interface {
+	// CreateQueue creates the named queue. It is not an error if the
+	// queue already exists.
+	CreateQueue(ctx context.Context, queue string) error
+
+	// DeleteQueue deletes the named queue and all its pending
+	// messages.
+	DeleteQueue(ctx context.Context, queue string) error
+
+	// Publish adds the message to the named queue.
+	Publish(ctx context.Context, queue string, msg *Message) error
+
+	// Receive receives the next message from the named queue. It
+	// blocks until a message is available or until the context is
+	// done. If the context is done before a message is received,
+	// Receive returns a nil message and a nil error.
+	Receive(ctx context.Context, queue string) (*Message, error)
+
+	// Ack acknowledges the received message identified by ackID. The
+	// acknowledged message is removed from the queue. Messages that
+	// are not acknowledged within AckDeadline are redelivered.
+	Ack(ctx context.Context, queue, ackID string) error
+
+	// Close closes the broker and releases all its resources.
+	Close() error
+}
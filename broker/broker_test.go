@@ -0,0 +1,329 @@
+//
+// broker_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock implements a manually advanced clock for the brokers.
+type testClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{
+		now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *testClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// receive receives a message with a timeout.
+func receive(t *testing.T, b Broker, queue string,
+	timeout time.Duration) (*Message, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return b.Receive(ctx, queue)
+}
+
+func mustReceive(t *testing.T, b Broker, queue string) *Message {
+	msg, err := receive(t, b, queue, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if msg == nil {
+		t.Fatalf("Receive: no message")
+	}
+	return msg
+}
+
+func mustPublish(t *testing.T, b Broker, queue, data string) {
+	err := b.Publish(context.Background(), queue, &Message{
+		Data: []byte(data),
+	})
+	if err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+}
+
+// newBrokerFunc creates a broker that uses the clock. The returned
+// function closes the broker and removes its resources.
+type newBrokerFunc func(t *testing.T, clock *testClock) (Broker, func())
+
+// testBroker tests the Broker interface semantics.
+func testBroker(t *testing.T, newBroker newBrokerFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b Broker, clock *testClock)
+	}{
+		{"Queues", testQueues},
+		{"Ack", testAck},
+		{"Redelivery", testRedelivery},
+		{"Expiration", testExpiration},
+		{"Wakeup", testWakeup},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newTestClock()
+			b, closeBroker := newBroker(t, clock)
+			defer closeBroker()
+			test.test(t, b, clock)
+		})
+	}
+}
+
+func testQueues(t *testing.T, b Broker, clock *testClock) {
+	ctx := context.Background()
+
+	err := b.Publish(ctx, "q", &Message{})
+	if err != ErrQueueNotFound {
+		t.Errorf("Publish to unknown queue: %v", err)
+	}
+	_, err = receive(t, b, "q", time.Second)
+	if err != ErrQueueNotFound {
+		t.Errorf("Receive from unknown queue: %v", err)
+	}
+	err = b.Ack(ctx, "q", "1.1")
+	if err != ErrQueueNotFound {
+		t.Errorf("Ack to unknown queue: %v", err)
+	}
+	err = b.DeleteQueue(ctx, "q")
+	if err != ErrQueueNotFound {
+		t.Errorf("DeleteQueue of unknown queue: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = b.CreateQueue(ctx, "q")
+		if err != nil {
+			t.Fatalf("CreateQueue: %s", err)
+		}
+	}
+	mustPublish(t, b, "q", "first")
+	mustPublish(t, b, "q", "second")
+	for _, expected := range []string{"first", "second"} {
+		msg := mustReceive(t, b, "q")
+		if string(msg.Data) != expected {
+			t.Errorf("received %q, expected %q", msg.Data, expected)
+		}
+	}
+
+	err = b.DeleteQueue(ctx, "q")
+	if err != nil {
+		t.Fatalf("DeleteQueue: %s", err)
+	}
+	err = b.Publish(ctx, "q", &Message{})
+	if err != ErrQueueNotFound {
+		t.Errorf("Publish to deleted queue: %v", err)
+	}
+
+	// A re-created queue does not have the old messages.
+	err = b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receive(t, b, "q", 10*time.Millisecond)
+	if err != nil || msg != nil {
+		t.Errorf("Receive from re-created queue: %v %v", msg, err)
+	}
+}
+
+func testAck(t *testing.T, b Broker, clock *testClock) {
+	ctx := context.Background()
+
+	err := b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPublish(t, b, "q", "acked")
+	mustPublish(t, b, "q", "unacked")
+	acked := mustReceive(t, b, "q")
+	unacked := mustReceive(t, b, "q")
+
+	err = b.Ack(ctx, "q", acked.AckID)
+	if err != nil {
+		t.Fatalf("Ack: %s", err)
+	}
+	err = b.Ack(ctx, "q", acked.AckID)
+	if err != ErrInvalidAckID {
+		t.Errorf("second Ack: %v", err)
+	}
+	err = b.Ack(ctx, "q", "invalid")
+	if err != ErrInvalidAckID {
+		t.Errorf("Ack with invalid ack ID: %v", err)
+	}
+
+	// Only the unacknowledged message is redelivered.
+	clock.Advance(AckDeadline + time.Second)
+	msg := mustReceive(t, b, "q")
+	if msg.ID != unacked.ID || string(msg.Data) != "unacked" {
+		t.Errorf("redelivered %s %q, expected %s", msg.ID, msg.Data,
+			unacked.ID)
+	}
+	msg, err = receive(t, b, "q", 10*time.Millisecond)
+	if err != nil || msg != nil {
+		t.Errorf("acknowledged message redelivered: %v %v", msg, err)
+	}
+}
+
+func testRedelivery(t *testing.T, b Broker, clock *testClock) {
+	ctx := context.Background()
+
+	err := b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPublish(t, b, "q", "data")
+	first := mustReceive(t, b, "q")
+
+	// The message is leased until the ack deadline.
+	clock.Advance(AckDeadline - time.Second)
+	msg, err := receive(t, b, "q", 10*time.Millisecond)
+	if err != nil || msg != nil {
+		t.Fatalf("leased message redelivered: %v %v", msg, err)
+	}
+
+	clock.Advance(2 * time.Second)
+	second := mustReceive(t, b, "q")
+	if second.ID != first.ID || string(second.Data) != "data" {
+		t.Errorf("redelivered %s %q, expected %s", second.ID, second.Data,
+			first.ID)
+	}
+	if second.AckID == first.AckID {
+		t.Errorf("redelivery has the same ack ID")
+	}
+
+	// The expired lease cannot be acknowledged.
+	err = b.Ack(ctx, "q", first.AckID)
+	if err != ErrInvalidAckID {
+		t.Errorf("Ack of expired lease: %v", err)
+	}
+	err = b.Ack(ctx, "q", second.AckID)
+	if err != nil {
+		t.Errorf("Ack: %s", err)
+	}
+}
+
+func testExpiration(t *testing.T, b Broker, clock *testClock) {
+	ctx := context.Background()
+
+	for _, queue := range []string{"used", "idle"} {
+		err := b.CreateQueue(ctx, queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(Expiration - time.Hour)
+	_, err := receive(t, b, "used", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+
+	err = b.Publish(ctx, "idle", &Message{})
+	if err != ErrQueueNotFound {
+		t.Errorf("Publish to expired queue: %v", err)
+	}
+	err = b.Publish(ctx, "used", &Message{})
+	if err != nil {
+		t.Errorf("Publish to used queue: %v", err)
+	}
+}
+
+func testWakeup(t *testing.T, b Broker, clock *testClock) {
+	ctx := context.Background()
+
+	err := b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		msg *Message
+		err error
+	}
+	start := func() chan result {
+		ch := make(chan result, 1)
+		go func() {
+			msg, err := receive(t, b, "q", 5*time.Second)
+			ch <- result{msg, err}
+		}()
+		// Let the receiver block.
+		time.Sleep(20 * time.Millisecond)
+		return ch
+	}
+	wait := func(ch chan result) result {
+		select {
+		case r := <-ch:
+			return r
+		case <-time.After(time.Second):
+			t.Fatalf("receiver not woken up")
+			return result{}
+		}
+	}
+
+	ch := start()
+	mustPublish(t, b, "q", "data")
+	r := wait(ch)
+	if r.err != nil || r.msg == nil || string(r.msg.Data) != "data" {
+		t.Errorf("Receive after Publish: %v %v", r.msg, r.err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	msg, err := b.Receive(cctx, "q")
+	if err != nil || msg != nil {
+		t.Errorf("Receive after cancel: %v %v", msg, err)
+	}
+
+	ch = start()
+	err = b.DeleteQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = wait(ch)
+	if r.err != ErrQueueNotFound {
+		t.Errorf("Receive after DeleteQueue: %v %v", r.msg, r.err)
+	}
+
+	// A receiver of an expired queue is woken up when the expiration
+	// is noticed.
+	err = b.CreateQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch = start()
+	clock.Advance(Expiration + time.Second)
+	err = b.Publish(ctx, "q", &Message{})
+	if err != ErrQueueNotFound {
+		t.Fatalf("Publish to expired queue: %v", err)
+	}
+	r = wait(ch)
+	if r.err != ErrQueueNotFound {
+		t.Errorf("Receive from expired queue: %v %v", r.msg, r.err)
+	}
+}
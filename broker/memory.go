@@ -0,0 +1,245 @@
+//
+// memory.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Memory implements an in-process Broker. Its queues are lost when
+// the process exits.
+type Memory struct {
+	now    func() time.Time
+	m      sync.Mutex
+	queues map[string]*memoryQueue
+	nextID uint64
+	closed bool
+}
+
+type memoryQueue struct {
+	pending  []*Message
+	leased   map[string]*memoryLease
+	notify   chan struct{}
+	lastUsed time.Time
+}
+
+type memoryLease struct {
+	msg      *Message
+	deadline time.Time
+}
+
+// wakeup wakes up all receivers waiting for the queue.
+func (q *memoryQueue) wakeup() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// redeliver moves all leases that have expired before now back to
+// the pending messages. It returns the deadline of the earliest
+// unexpired lease or zero time if the queue has no leases.
+func (q *memoryQueue) redeliver(now time.Time) time.Time {
+	var next time.Time
+	for ackID, lease := range q.leased {
+		if now.Before(lease.deadline) {
+			if next.IsZero() || lease.deadline.Before(next) {
+				next = lease.deadline
+			}
+			continue
+		}
+		delete(q.leased, ackID)
+		q.pending = append([]*Message{lease.msg}, q.pending...)
+	}
+	return next
+}
+
+// NewMemory creates a new in-memory broker.
+func NewMemory() *Memory {
+	return &Memory{
+		now:    time.Now,
+		queues: make(map[string]*memoryQueue),
+	}
+}
+
+// queue returns the named queue. The function must be called with
+// b.m locked.
+func (b *Memory) queue(name string, now time.Time) (*memoryQueue, error) {
+	if b.closed {
+		return nil, fmt.Errorf("broker closed")
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+	if now.Sub(q.lastUsed) > Expiration {
+		delete(b.queues, name)
+		q.wakeup()
+		return nil, ErrQueueNotFound
+	}
+	return q, nil
+}
+
+func (b *Memory) newID() string {
+	b.nextID++
+	return fmt.Sprintf("%d", b.nextID)
+}
+
+// CreateQueue implements Broker.CreateQueue.
+func (b *Memory) CreateQueue(ctx context.Context, queue string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("broker closed")
+	}
+	now := b.now()
+
+	// Expire unused queues.
+	for name, q := range b.queues {
+		if now.Sub(q.lastUsed) > Expiration {
+			delete(b.queues, name)
+			q.wakeup()
+		}
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		q = &memoryQueue{
+			leased: make(map[string]*memoryLease),
+			notify: make(chan struct{}),
+		}
+		b.queues[queue] = q
+	}
+	q.lastUsed = now
+
+	return nil
+}
+
+// DeleteQueue implements Broker.DeleteQueue.
+func (b *Memory) DeleteQueue(ctx context.Context, queue string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	q, err := b.queue(queue, b.now())
+	if err != nil {
+		return err
+	}
+	delete(b.queues, queue)
+	q.wakeup()
+
+	return nil
+}
+
+// Publish implements Broker.Publish.
+func (b *Memory) Publish(ctx context.Context, queue string, msg *Message) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	q, err := b.queue(queue, b.now())
+	if err != nil {
+		return err
+	}
+	q.pending = append(q.pending, &Message{
+		ID:         b.newID(),
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+	q.wakeup()
+
+	return nil
+}
+
+// Receive implements Broker.Receive.
+func (b *Memory) Receive(ctx context.Context, queue string) (*Message, error) {
+	for {
+		b.m.Lock()
+		now := b.now()
+		q, err := b.queue(queue, now)
+		if err != nil {
+			b.m.Unlock()
+			return nil, err
+		}
+		q.lastUsed = now
+		next := q.redeliver(now)
+
+		if len(q.pending) > 0 {
+			msg := q.pending[0]
+			q.pending = q.pending[1:]
+
+			ackID := b.newID()
+			q.leased[ackID] = &memoryLease{
+				msg:      msg,
+				deadline: now.Add(AckDeadline),
+			}
+			b.m.Unlock()
+
+			return &Message{
+				ID:         msg.ID,
+				Data:       msg.Data,
+				Attributes: msg.Attributes,
+				AckID:      ackID,
+			}, nil
+		}
+		notify := q.notify
+		b.m.Unlock()
+
+		// Wait for new messages or for the next lease to expire.
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-notify:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+	}
+}
+
+// Ack implements Broker.Ack.
+func (b *Memory) Ack(ctx context.Context, queue, ackID string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	q, err := b.queue(queue, b.now())
+	if err != nil {
+		return err
+	}
+	_, ok := q.leased[ackID]
+	if !ok {
+		return ErrInvalidAckID
+	}
+	delete(q.leased, ackID)
+
+	return nil
+}
+
+// Close implements Broker.Close.
+func (b *Memory) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	for _, q := range b.queues {
+		q.wakeup()
+	}
+	b.queues = make(map[string]*memoryQueue)
+
+	return nil
+}
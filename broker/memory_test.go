@@ -0,0 +1,23 @@
+//
+// memory_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"testing"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	testBroker(t, func(t *testing.T, clock *testClock) (Broker, func()) {
+		b := NewMemory()
+		b.now = clock.Now
+		return b, func() {
+			b.Close()
+		}
+	})
+}
@@ -0,0 +1,207 @@
+//
+// pubsub.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	pubsubapi "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PubSub implements Broker with Google Cloud Pub/Sub. Each queue is
+// implemented with a topic and a subscription.
+type PubSub struct {
+	projectID  string
+	client     *pubsub.Client
+	subscriber *pubsubapi.SubscriberClient
+}
+
+// NewPubSub creates a new Pub/Sub broker for the project.
+func NewPubSub(ctx context.Context, projectID string) (*PubSub, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	// The subscriber client is used for synchronous pulls so that
+	// messages can be acknowledged after Receive has returned.
+	subscriber, err := pubsubapi.NewSubscriberClient(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &PubSub{
+		projectID:  projectID,
+		client:     client,
+		subscriber: subscriber,
+	}, nil
+}
+
+func topicID(queue string) string {
+	return "t" + queue
+}
+
+func subscriptionID(queue string) string {
+	return "s" + queue
+}
+
+func (b *PubSub) subscriptionName(queue string) string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s",
+		b.projectID, subscriptionID(queue))
+}
+
+// CreateQueue implements Broker.CreateQueue.
+func (b *PubSub) CreateQueue(ctx context.Context, queue string) error {
+	topic := b.client.Topic(topicID(queue))
+	ok, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("topic.Exists: %s", err)
+	}
+	if !ok {
+		topic, err = b.client.CreateTopic(ctx, topicID(queue))
+		if err != nil {
+			return fmt.Errorf("client.CreateTopic: %s", err)
+		}
+	}
+
+	sub := b.client.Subscription(subscriptionID(queue))
+	ok, err = sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("sub.Exists: %s", err)
+	}
+	if !ok {
+		_, err = b.client.CreateSubscription(ctx, subscriptionID(queue),
+			pubsub.SubscriptionConfig{
+				Topic:            topic,
+				AckDeadline:      AckDeadline,
+				ExpirationPolicy: Expiration,
+			})
+		if err != nil {
+			return fmt.Errorf("client.CreateSubscription: %s", err)
+		}
+	}
+	return nil
+}
+
+// DeleteQueue implements Broker.DeleteQueue.
+func (b *PubSub) DeleteQueue(ctx context.Context, queue string) error {
+	// The subscription expires when it is not used but the topic
+	// stays. Delete whichever of them still exists.
+	sub := b.client.Subscription(subscriptionID(queue))
+	subExists, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("sub.Exists: %s", err)
+	}
+	topic := b.client.Topic(topicID(queue))
+	topicExists, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("topic.Exists: %s", err)
+	}
+	if !subExists && !topicExists {
+		return ErrQueueNotFound
+	}
+
+	var msg string
+	if subExists {
+		err = sub.Delete(ctx)
+		if err != nil {
+			msg = fmt.Sprintf("Subscription: %s", err)
+		}
+	}
+	if topicExists {
+		err = topic.Delete(ctx)
+		if err != nil {
+			if len(msg) > 0 {
+				msg += ", "
+			}
+			msg += fmt.Sprintf("Topic: %s", err)
+		}
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// Publish implements Broker.Publish.
+func (b *PubSub) Publish(ctx context.Context, queue string, msg *Message) error {
+	topic := b.client.Topic(topicID(queue))
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+	_, err := result.Get(ctx)
+	topic.Stop()
+	if err != nil {
+		return pubsubError("topic.Publish", err)
+	}
+	return nil
+}
+
+// Receive implements Broker.Receive.
+func (b *PubSub) Receive(ctx context.Context, queue string) (*Message, error) {
+	for {
+		resp, err := b.subscriber.Pull(ctx, &pubsubpb.PullRequest{
+			Subscription: b.subscriptionName(queue),
+			MaxMessages:  1,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, pubsubError("subscriber.Pull", err)
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			continue
+		}
+		m := resp.ReceivedMessages[0]
+		return &Message{
+			ID:         m.Message.MessageId,
+			Data:       m.Message.Data,
+			Attributes: m.Message.Attributes,
+			AckID:      m.AckId,
+		}, nil
+	}
+}
+
+// Ack implements Broker.Ack.
+func (b *PubSub) Ack(ctx context.Context, queue, ackID string) error {
+	err := b.subscriber.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{
+		Subscription: b.subscriptionName(queue),
+		AckIds:       []string{ackID},
+	})
+	if err != nil {
+		return pubsubError("subscriber.Acknowledge", err)
+	}
+	return nil
+}
+
+// pubsubError returns ErrQueueNotFound if the topic or subscription
+// of the queue does not exist. Other errors are annotated with the
+// failed operation.
+func pubsubError(op string, err error) error {
+	if status.Code(err) == codes.NotFound {
+		return ErrQueueNotFound
+	}
+	return fmt.Errorf("%s: %s", op, err)
+}
+
+// Close implements Broker.Close.
+func (b *PubSub) Close() error {
+	err := b.subscriber.Close()
+	cerr := b.client.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
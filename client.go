@@ -15,80 +15,143 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-	"github.com/markkurossi/cloudsdk/api/auth"
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
+)
+
+const (
+	// ClientLease specifies the default lease duration of client
+	// sessions.
+	ClientLease = 2 * time.Minute
 )
 
 var (
-	rePath = regexp.MustCompilePOSIX(`^/clients/([a-f0-9]{16,32})$`)
+	rePath = regexp.MustCompilePOSIX(`^/clients/([a-f0-9]{16,32})(/ack|/cancel)?$`)
 )
 
-// Clients hand REST calls to the "/clients" URI.
-func Clients(w http.ResponseWriter, r *http.Request) {
+// Clients handles REST calls to the "/clients" URI.
+func (relay *Relay) Clients(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
 
-	token := auth.Authorize(w, r, REALM, tokenVerifier, nil)
-	if token == nil {
+	principal := relay.authn.Authenticate(w, r)
+	if principal == nil {
 		return
 	}
-
-	ctx := context.Background()
-
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		Error500f(w, "NewClient failed: %s", err)
+	if !requireScope(w, principal, ScopeClientConnect) {
 		return
 	}
 
+	ctx := r.Context()
+
 	switch r.Method {
 	case "POST":
 		// Register new client.
-		id, err := NewID()
+		key, ok := idempotencyKey(r)
+		if !ok {
+			Errorf(w, http.StatusBadRequest, "Invalid idempotency key")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			Error500f(w, "NewID: %s", err)
+			Error500f(w, "ioutil.ReadAll: %s", err)
 			return
 		}
-		// Create a topic for response.
-		respTopic, err := client.CreateTopic(ctx, id.Topic())
+		req := new(ClientConnectRequest)
+		err = json.Unmarshal(data, req)
 		if err != nil {
-			Error500f(w, "client.CreateTopic: %s", err)
+			Errorf(w, http.StatusBadRequest, "Invalid request data: %s", err)
 			return
 		}
-		// Subscribe for response.
-		_, err = client.CreateSubscription(ctx, id.Subscription(),
-			pubsub.SubscriptionConfig{
-				Topic:            respTopic,
-				AckDeadline:      10 * time.Second,
-				ExpirationPolicy: 25 * time.Hour,
-			})
+		agents := req.Agents
+		if len(agents) == 0 {
+			agents = []string{req.Agent}
+		}
+		for _, agentID := range agents {
+			if !reAgentID.MatchString(agentID) {
+				Errorf(w, http.StatusBadRequest, "Invalid agent ID '%s'",
+					agentID)
+				return
+			}
+			_, err = relay.store.GetAgent(ctx, agentID)
+			if err == store.ErrNotFound {
+				Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+				return
+			} else if err != nil {
+				Error500f(w, "GetAgent: %s", err)
+				return
+			}
+		}
+		var id ID
+		if len(key) > 0 {
+			// Retried requests get the session that the first
+			// request created.
+			id = idempotentID(principal.Subject, key)
+			client, err := relay.store.GetClient(ctx, id.String())
+			if err == nil {
+				writeJSON(w, newClientConnectResult(client))
+				return
+			} else if err != store.ErrNotFound {
+				Error500f(w, "GetClient: %s", err)
+				return
+			}
+		} else {
+			id, err = NewID()
+			if err != nil {
+				Error500f(w, "NewID: %s", err)
+				return
+			}
+		}
+		// Create a queue for responses.
+		err = relay.broker.CreateQueue(ctx, clientQueue(id))
 		if err != nil {
-			Error500f(w, "client.CreateSubscription: %s", err)
+			Error500f(w, "CreateQueue: %s", err)
 			return
 		}
-		result := &ClientConnectResult{
-			URL: "/clients/" + id.String(),
-			ID:  id.String(),
+		now := time.Now()
+		client := &store.Client{
+			ID:           id.String(),
+			Subject:      principal.Subject,
+			Agents:       agents,
+			Created:      now,
+			LastActivity: now,
+			Lease:        relay.clientLease,
 		}
-		data, err := json.Marshal(result)
+		err = relay.store.PutClient(ctx, client)
 		if err != nil {
-			Error500f(w, "json.Marshal: %s", err)
+			Error500f(w, "PutClient: %s", err)
 			return
 		}
-		w.Write(data)
+		writeJSON(w, newClientConnectResult(client))
 
 	default:
 		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
 	}
 }
 
-// Clients hand REST calls to the "/clients/{ID}" URI.
-func Client(w http.ResponseWriter, r *http.Request) {
+// newClientConnectResult creates the connect result for the client
+// session.
+func newClientConnectResult(client *store.Client) *ClientConnectResult {
+	return &ClientConnectResult{
+		URL:    "/clients/" + client.ID,
+		ID:     client.ID,
+		Agent:  client.Agents[0],
+		Agents: client.Agents,
+		Lease:  int(client.Lease / time.Second),
+	}
+}
+
+// Client handles REST calls to the "/clients/{ID}" URI.
+func (relay *Relay) Client(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
 
-	token := auth.Authorize(w, r, REALM, tokenVerifier, nil)
-	if token == nil {
+	principal := relay.authn.Authenticate(w, r)
+	if principal == nil {
+		return
+	}
+	if !requireScope(w, principal, ScopeClientConnect) {
 		return
 	}
 
@@ -99,21 +162,58 @@ func Client(w http.ResponseWriter, r *http.Request) {
 	}
 	clientID := m[1]
 
-	ctx := context.Background()
+	ctx := r.Context()
 
-	client, err := pubsub.NewClient(ctx, projectID)
+	id, err := ParseID(clientID)
 	if err != nil {
-		Error500f(w, "NewClient failed: %s", err)
+		Error500f(w, "Invalid client ID: %s", err)
 		return
 	}
-	id, err := ParseID(clientID)
+	client, err := relay.store.GetClient(ctx, id.String())
+	if err == store.ErrNotFound {
+		Errorf(w, http.StatusNotFound, "Unknown client %s", id)
+		return
+	} else if err != nil {
+		Error500f(w, "GetClient: %s", err)
+		return
+	}
+	if !authorized(principal, client.Subject) {
+		Errorf(w, http.StatusForbidden, "Access denied to client %s", id)
+		return
+	}
+	now := time.Now()
+	if client.Expired(now) {
+		err = relay.deleteClient(ctx, id)
+		if err != nil {
+			Error500f(w, "deleteClient: %s", err)
+			return
+		}
+		Errorf(w, http.StatusGone, "Session expired")
+		return
+	}
+	// All requests renew the session's lease.
+	err = relay.store.SetClientLastActivity(ctx, client.ID, now)
 	if err != nil {
-		Error500f(w, "Invalid client ID: %s", err)
+		Error500f(w, "SetClientLastActivity: %s", err)
+		return
+	}
+	switch m[2] {
+	case "/ack":
+		relay.ack(ctx, w, r, clientQueue(id))
+		return
+
+	case "/cancel":
+		relay.cancel(ctx, w, r, client)
 		return
 	}
 
 	switch r.Method {
 	case "POST":
+		key, ok := idempotencyKey(r)
+		if !ok {
+			Errorf(w, http.StatusBadRequest, "Invalid idempotency key")
+			return
+		}
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			Error500f(w, "ioutil.ReadAll: %s", err)
@@ -125,39 +225,121 @@ func Client(w http.ResponseWriter, r *http.Request) {
 			Errorf(w, http.StatusBadRequest, "Invalid message data: %s", err)
 			return
 		}
+		if msg.Version > ProtocolVersion {
+			Errorf(w, http.StatusBadRequest,
+				"Unsupported protocol version %d", msg.Version)
+			return
+		}
 		payload, err := msg.Bytes()
 		if err != nil {
 			Errorf(w, http.StatusBadRequest, "Invalid message payload: %s", err)
 			return
 		}
-		id, err := ParseID(msg.From)
-		if err != nil {
-			Errorf(w, http.StatusBadRequest, "Invalid from ID '%s': %s",
-				msg.From, err)
+		// The responses are sent to the session of the URL. A client
+		// cannot direct them to other sessions.
+		if msg.From != client.ID {
+			Errorf(w, http.StatusForbidden, "Invalid from ID '%s'", msg.From)
+			return
+		}
+		if msg.Expired(time.Now()) {
+			Errorf(w, http.StatusBadRequest, "Request deadline exceeded")
+			return
+		}
+		if len(msg.Agent) > 0 && !client.HasAgent(msg.Agent) {
+			Errorf(w, http.StatusBadRequest, "Invalid agent ID '%s'",
+				msg.Agent)
+			return
+		}
+		var agentID string
+		var response []byte
+
+		kind := msg.MessageKind()
+		switch kind {
+		case KindData:
+			if len(msg.Session) > 0 {
+				// The relay cannot route encrypted requests. The
+				// client selects the agent.
+				agentID = msg.Agent
+				if len(agentID) == 0 {
+					agentID = client.Agents[0]
+				}
+				break
+			}
+			agentID, response, err = relay.route(ctx, client, msg.Agent,
+				payload)
+			if err != nil {
+				Errorf(w, http.StatusBadRequest, "Invalid request: %s", err)
+				return
+			}
+
+		case KindPing, KindHandshake:
+			agentID = msg.Agent
+			if len(agentID) == 0 {
+				agentID = client.Agents[0]
+			}
+
+		default:
+			Errorf(w, http.StatusBadRequest, "Invalid message kind '%s'",
+				msg.Kind)
+			return
+		}
+		if response != nil {
+			// The relay answered the request.
+			msg = &Message{
+				Version: ProtocolVersion,
+				ID:      msg.ID,
+				Channel: msg.Channel,
+			}
+			msg.SetBytes(response)
+			writeJSON(w, msg)
+			return
+		}
+
+		// Fail fast if the agent is not polling for requests.
+		agent, err := relay.store.GetAgent(ctx, agentID)
+		if err == store.ErrNotFound {
+			Errorf(w, http.StatusNotFound, "Unknown agent %s", agentID)
+			return
+		} else if err != nil {
+			Error500f(w, "GetAgent: %s", err)
+			return
+		}
+		if !agentOnline(agent, time.Now()) {
+			Errorf(w, http.StatusServiceUnavailable, "Agent %s offline",
+				agentID)
 			return
 		}
 
 		// Send request.
-		reqTopic := client.Topic(TOPIC_AUTHORIZER)
-		result := reqTopic.Publish(ctx, &pubsub.Message{
-			Data: payload,
-			Attributes: map[string]string{
-				ATTR_RESPONSE: id.String(),
-			},
-		})
-		_, err = result.Get(ctx)
-		reqTopic.Stop()
-		if err != nil {
-			Error500f(w, "reqTopic.Publish: %s", err)
+		attrs := map[string]string{
+			ATTR_KIND:       string(kind),
+			ATTR_RESPONSE:   id.String(),
+			ATTR_REQUEST_ID: msg.ID,
+			ATTR_CHANNEL:    msg.Channel,
+		}
+		if !msg.Deadline.IsZero() {
+			attrs[ATTR_DEADLINE] = msg.Deadline.Format(time.RFC3339Nano)
+		}
+		if len(msg.Session) > 0 {
+			attrs[ATTR_SESSION] = msg.Session
+		}
+		err = relay.publish(ctx, agentQueue(agentID), key,
+			&broker.Message{
+				Data:       payload,
+				Attributes: attrs,
+			})
+		if err == broker.ErrQueueNotFound {
+			Errorf(w, http.StatusServiceUnavailable, "Agent %s offline",
+				agentID)
+			return
+		} else if err != nil {
+			Error500f(w, "Publish: %s", err)
 			return
 		}
 		fallthrough
 
 	case "GET":
 		// Receive response.
-
-		var response *pubsub.Message
-
 		var timeout time.Duration
 		if r.Method == "POST" {
 			timeout = 30 * time.Second
@@ -168,18 +350,12 @@ func Client(w http.ResponseWriter, r *http.Request) {
 		cctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		sub := client.Subscription(id.Subscription())
-		err = sub.Receive(cctx, func(ctx context.Context, m *pubsub.Message) {
-			if false {
-				fmt.Printf("m: ID=%s, Data=%q, Attributes=%q\n",
-					m.ID, m.Data, m.Attributes)
-			}
-			response = m
-			m.Ack()
-			cancel()
-		})
-		if err != nil {
-			Error500f(w, "sub.Receive: %s", err)
+		response, err := relay.broker.Receive(cctx, clientQueue(id))
+		if err == broker.ErrQueueNotFound {
+			Errorf(w, http.StatusGone, "Session expired")
+			return
+		} else if err != nil {
+			Error500f(w, "Receive: %s", err)
 			return
 		}
 		if response == nil {
@@ -190,8 +366,21 @@ func Client(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-
-		msg := new(Message)
+		// The response is acknowledged by the client after it has
+		// received it. Unacknowledged responses are redelivered.
+		msg := &Message{
+			Version: ProtocolVersion,
+			Kind:    Kind(response.Attributes[ATTR_KIND]),
+			ID:      response.Attributes[ATTR_REQUEST_ID],
+			Channel: response.Attributes[ATTR_CHANNEL],
+			AckID:   response.AckID,
+			Session: response.Attributes[ATTR_SESSION],
+		}
+		if msg.Kind == KindError {
+			code, _ := strconv.Atoi(response.Attributes[ATTR_ERROR_CODE])
+			msg.Code = ErrorCode(code)
+			msg.Reason = response.Attributes[ATTR_REASON]
+		}
 		msg.SetBytes(response.Data)
 
 		data, err := json.Marshal(msg)
@@ -201,22 +390,27 @@ func Client(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Write(data)
 
-	case "DELETE":
-		var msg string
+	case "PUT":
+		// Heartbeat. The lease was renewed above.
+		w.WriteHeader(http.StatusOK)
 
-		err := client.Subscription(id.Subscription()).Delete(ctx)
-		if err != nil {
-			msg = fmt.Sprintf("Subscription: %s", err)
-		}
-		err = client.Topic(id.Topic()).Delete(ctx)
-		if err != nil {
-			if len(msg) > 0 {
-				msg += ", "
+	case "DELETE":
+		// Notify the agents that the session is closed.
+		for _, agentID := range client.Agents {
+			err := relay.broker.Publish(ctx, agentQueue(agentID),
+				&broker.Message{
+					Attributes: map[string]string{
+						ATTR_KIND:     string(KindClose),
+						ATTR_RESPONSE: client.ID,
+					},
+				})
+			if err != nil {
+				fmt.Printf("Publish close to %s: %s\n", agentID, err)
 			}
-			msg += fmt.Sprintf("Topic: %s", err)
 		}
-		if len(msg) > 0 {
-			Error500f(w, "%s", msg)
+		err := relay.deleteClient(ctx, id)
+		if err != nil {
+			Error500f(w, "deleteClient: %s", err)
 		} else {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -225,3 +419,64 @@ func Client(w http.ResponseWriter, r *http.Request) {
 		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
 	}
 }
+
+// cancel handles request cancellations of the client session. The
+// relay drops the cancelled request if it has not been delivered yet.
+// The agents are notified about the cancellation so they can drop
+// requests that they have already received.
+func (relay *Relay) cancel(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, client *store.Client) {
+
+	if r.Method != "POST" {
+		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Error500f(w, "ioutil.ReadAll: %s", err)
+		return
+	}
+	req := new(CancelRequest)
+	err = json.Unmarshal(data, req)
+	if err != nil {
+		Errorf(w, http.StatusBadRequest, "Invalid request data: %s", err)
+		return
+	}
+	if len(req.ID) == 0 {
+		Errorf(w, http.StatusBadRequest, "No request ID")
+		return
+	}
+	err = relay.store.CancelRequest(ctx, client.ID, req.ID)
+	if err != nil {
+		Error500f(w, "CancelRequest: %s", err)
+		return
+	}
+	for _, agentID := range client.Agents {
+		err = relay.broker.Publish(ctx, agentQueue(agentID),
+			&broker.Message{
+				Attributes: map[string]string{
+					ATTR_KIND:       string(KindCancel),
+					ATTR_RESPONSE:   client.ID,
+					ATTR_REQUEST_ID: req.ID,
+				},
+			})
+		if err != nil {
+			Error500f(w, "Publish: %s", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteClient deletes the client session and its response queue.
+func (relay *Relay) deleteClient(ctx context.Context, id ID) error {
+	err := relay.broker.DeleteQueue(ctx, clientQueue(id))
+	if err != nil && err != broker.ErrQueueNotFound {
+		return err
+	}
+	err = relay.store.DeleteClient(ctx, id.String())
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return nil
+}
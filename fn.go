@@ -9,29 +9,38 @@
 package authorizer
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 
+	"github.com/markkurossi/authorizer/authn"
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
 	"github.com/markkurossi/cloudsdk/api/auth"
 	"github.com/markkurossi/go-libs/fn"
 )
 
 const (
-	REALM            = "Service Proxy"
-	TOPIC_AUTHORIZER = "Authorizer"
-	SUB_REQUESTS     = "Requests"
-	ATTR_RESPONSE    = "response"
+	REALM           = "Service Proxy"
+	ATTR_RESPONSE   = "response"
+	ATTR_REQUEST_ID = "request"
+	ATTR_CHANNEL    = "channel"
+	ATTR_DEADLINE   = "deadline"
+	ATTR_KIND       = "kind"
+	ATTR_ERROR_CODE = "errorCode"
+	ATTR_REASON     = "reason"
+	ATTR_SESSION    = "session"
 )
 
 var (
-	mux        *http.ServeMux
-	projectID  string
-	store      *auth.ClientStore
-	authPubkey ed25519.PublicKey
+	gcpOnce  sync.Once
+	gcpRelay *Relay
 )
 
 func Fatalf(format string, a ...interface{}) {
@@ -39,40 +48,85 @@ func Fatalf(format string, a ...interface{}) {
 	os.Exit(1)
 }
 
-func init() {
-	mux = http.NewServeMux()
-	mux.HandleFunc("/agents", Agents)
-	mux.HandleFunc("/agents/", Agent)
-	mux.HandleFunc("/clients", Clients)
-	mux.HandleFunc("/clients/", Client)
+// Environment variables that configure the Cloud Functions relay.
+const (
+	// ENV_AUTH selects the authentication method: cloudsdk (the
+	// default), jwt, or apikey.
+	ENV_AUTH = "AUTHORIZER_AUTH"
+	// ENV_JWKS specifies the JWKS file of the jwt method.
+	ENV_JWKS = "AUTHORIZER_JWKS"
+	// ENV_JWT_ISSUER specifies the required JWT issuer.
+	ENV_JWT_ISSUER = "AUTHORIZER_JWT_ISSUER"
+	// ENV_JWT_AUDIENCE specifies the required JWT audience.
+	ENV_JWT_AUDIENCE = "AUTHORIZER_JWT_AUDIENCE"
+	// ENV_API_KEYS specifies the API keys file of the apikey method.
+	ENV_API_KEYS = "AUTHORIZER_API_KEYS"
+)
 
-	id, err := fn.GetProjectID()
+// initGCP creates the relay for the Cloud Functions environment. It
+// uses the project's Pub/Sub as the message broker and Firestore as
+// the relay store. The authentication method is selected with the
+// environment variables.
+func initGCP() {
+	projectID, err := fn.GetProjectID()
 	if err != nil {
 		Fatalf("GetProjectID: %s\n", err)
 	}
-	projectID = id
 
-	store, err = auth.NewClientStore()
+	msgBroker, err := broker.NewPubSub(context.Background(), projectID)
 	if err != nil {
-		Fatalf("NewClientStore: %s\n", err)
+		Fatalf("NewPubSub: %s\n", err)
 	}
+	relayStore, err := store.NewFirestore(context.Background(), projectID)
+	if err != nil {
+		Fatalf("NewFirestore: %s\n", err)
+	}
+	authenticator, err := gcpAuthenticator()
+	if err != nil {
+		Fatalf("%s\n", err)
+	}
+	gcpRelay = NewRelay(msgBroker, relayStore, authenticator)
+}
+
+// gcpAuthenticator creates the authenticator for the method in the
+// ENV_AUTH environment variable. The cloudsdk method fetches the auth
+// public key from the client store.
+func gcpAuthenticator() (authn.Authenticator, error) {
+	return authn.New(authn.Config{
+		Method:        os.Getenv(ENV_AUTH),
+		Realm:         REALM,
+		PublicKeyFunc: clientStorePubkey,
+		JWT: authn.JWTConfig{
+			JWKSFile: os.Getenv(ENV_JWKS),
+			Issuer:   os.Getenv(ENV_JWT_ISSUER),
+			Audience: os.Getenv(ENV_JWT_AUDIENCE),
+		},
+		APIKeysFile: os.Getenv(ENV_API_KEYS),
+	})
+}
 
+// clientStorePubkey fetches the auth public key from the client
+// store.
+func clientStorePubkey() (ed25519.PublicKey, error) {
+	store, err := auth.NewClientStore()
+	if err != nil {
+		return nil, fmt.Errorf("NewClientStore: %s", err)
+	}
 	assets, err := store.Asset(auth.ASSET_AUTH_PUBKEY)
 	if err != nil {
-		Fatalf("store.Asset(%s)\n", auth.ASSET_AUTH_PUBKEY)
+		return nil, fmt.Errorf("store.Asset(%s): %s",
+			auth.ASSET_AUTH_PUBKEY, err)
 	}
 	if len(assets) == 0 {
-		Fatalf("No auth public key\n")
+		return nil, fmt.Errorf("No auth public key")
 	}
-	authPubkey = ed25519.PublicKey(assets[0].Data)
+	return ed25519.PublicKey(assets[0].Data), nil
 }
 
+// ServiceProxy is the Cloud Functions entry point.
 func ServiceProxy(w http.ResponseWriter, r *http.Request) {
-	mux.ServeHTTP(w, r)
-}
-
-func tokenVerifier(message, sig []byte) bool {
-	return ed25519.Verify(authPubkey, message, sig)
+	gcpOnce.Do(initGCP)
+	gcpRelay.ServeHTTP(w, r)
 }
 
 func Errorf(w http.ResponseWriter, code int, format string, a ...interface{}) {
@@ -83,18 +137,29 @@ func Error500f(w http.ResponseWriter, format string, a ...interface{}) {
 	Errorf(w, http.StatusInternalServerError, format, a...)
 }
 
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		Error500f(w, "json.Marshal: %s", err)
+		return
+	}
+	w.Write(data)
+}
+
 type ID []byte
 
 func (id ID) String() string {
 	return fmt.Sprintf("%x", []byte(id))
 }
 
-func (id ID) Topic() string {
-	return fmt.Sprintf("t%x", []byte(id))
+// clientQueue returns the name of the response queue of the client.
+func clientQueue(id ID) string {
+	return "client-" + id.String()
 }
 
-func (id ID) Subscription() string {
-	return fmt.Sprintf("s%x", []byte(id))
+// agentQueue returns the name of the request queue of the agent.
+func agentQueue(agentID string) string {
+	return "agent-" + agentID
 }
 
 func NewID() (ID, error) {
@@ -4,16 +4,20 @@ go 1.13
 
 require (
 	cloud.google.com/go v0.110.9 // indirect
-	cloud.google.com/go/firestore v1.14.0 // indirect
+	cloud.google.com/go/firestore v1.14.0
 	cloud.google.com/go/pubsub v1.33.0
 	github.com/GoogleCloudPlatform/functions-framework-go v1.8.0
+	github.com/flynn/noise v1.1.0
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/markkurossi/cloudsdk v0.0.0-20230221115831-3710d9ed6c71
 	github.com/markkurossi/go-libs v0.0.0-20231021085705-6cfae458d95a
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	go.etcd.io/bbolt v1.3.8
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.26.0 // indirect
+	golang.org/x/crypto v0.14.0
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 	google.golang.org/genproto v0.0.0-20231016165738-49dd2c1f3d0b // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20231016165738-49dd2c1f3d0b // indirect
+	google.golang.org/grpc v1.59.0
 )
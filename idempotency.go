@@ -0,0 +1,78 @@
+//
+// idempotency.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authorizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
+)
+
+const (
+	// IdempotencyKeyHeader is the HTTP header that carries the
+	// idempotency key of a POST request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotencyKeyTTL specifies how long the idempotency keys are
+	// remembered.
+	IdempotencyKeyTTL = 10 * time.Minute
+)
+
+var reIdempotencyKey = regexp.MustCompilePOSIX(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// idempotencyKey returns the request's idempotency key. It returns
+// false if the key is invalid.
+func idempotencyKey(r *http.Request) (string, bool) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) == 0 {
+		return "", true
+	}
+	return key, reIdempotencyKey.MatchString(key)
+}
+
+// idempotentID derives the ID of the resource that the request with
+// the idempotency key creates. The key is scoped to the subject so
+// retried requests of the subject create the same resource.
+func idempotentID(subject, key string) ID {
+	sum := sha256.Sum256([]byte(subject + "\x00" + key))
+	return ID(sum[:16])
+}
+
+// publish publishes the message to the queue. If the idempotency key
+// is set, retried requests with the same key are published only once.
+func (relay *Relay) publish(ctx context.Context, queue, key string,
+	msg *broker.Message) error {
+
+	if len(key) == 0 {
+		return relay.broker.Publish(ctx, queue, msg)
+	}
+	storeKey := queue + "-" + key
+
+	err := relay.store.PutIdempotencyKey(ctx, storeKey,
+		time.Now().Add(IdempotencyKeyTTL))
+	if err == store.ErrExists {
+		fmt.Printf("Ignoring duplicate request %s to %s\n", key, queue)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = relay.broker.Publish(ctx, queue, msg)
+	if err != nil {
+		// Let the retried request publish the message.
+		relay.store.DeleteIdempotencyKey(ctx, storeKey)
+		return err
+	}
+	return nil
+}
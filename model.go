@@ -10,21 +10,147 @@ package authorizer
 
 import (
 	"encoding/base64"
+	"fmt"
+	"time"
 )
 
+type ClientConnectRequest struct {
+	Agent  string   `json:"agent"`
+	Agents []string `json:"agents,omitempty"`
+}
+
 type ClientConnectResult struct {
-	URL string `json:"url"`
-	ID  string `json:"id"`
+	URL    string   `json:"url"`
+	ID     string   `json:"id"`
+	Agent  string   `json:"agent"`
+	Agents []string `json:"agents"`
+	Lease  int      `json:"lease"`
+}
+
+type ServerConnectRequest struct {
+	ID         string      `json:"id,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Owner      string      `json:"owner,omitempty"`
+	Identities []*Identity `json:"identities,omitempty"`
+	PublicKey  []byte      `json:"publicKey,omitempty"`
+}
+
+type Identity struct {
+	Key     []byte `json:"key"`
+	Comment string `json:"comment"`
 }
 
 type ServerConnectResult struct {
 	URL string `json:"url"`
+	ID  string `json:"id"`
+}
+
+type AgentInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner"`
+	Created      time.Time `json:"created"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Online       bool      `json:"online"`
+	Available    bool      `json:"available"`
+	Fingerprints []string  `json:"fingerprints"`
+	PublicKey    []byte    `json:"publicKey,omitempty"`
+}
+
+type AgentStatus struct {
+	Available bool `json:"available"`
+}
+
+type AgentList struct {
+	Agents []*AgentInfo `json:"agents"`
+}
+
+type SweepResult struct {
+	Removed []string `json:"removed"`
+}
+
+type CancelRequest struct {
+	ID string `json:"id"`
+}
+
+type AckRequest struct {
+	AckID string `json:"ackID"`
+}
+
+// ProtocolVersion specifies the relay protocol version.
+const ProtocolVersion = 1
+
+// Kind specifies the message kind.
+type Kind string
+
+// Message kinds.
+const (
+	KindData      Kind = "data"
+	KindPing      Kind = "ping"
+	KindPong      Kind = "pong"
+	KindCancel    Kind = "cancel"
+	KindClose     Kind = "close"
+	KindError     Kind = "error"
+	KindHandshake Kind = "handshake"
+)
+
+// ErrorCode specifies the error of an error message.
+type ErrorCode int
+
+// Error codes.
+const (
+	ErrorUnknown ErrorCode = iota
+	ErrorInvalidRequest
+	ErrorAgentUnavailable
+	ErrorAgentFailure
+	ErrorUnknownSession
+)
+
+var errorCodes = map[ErrorCode]string{
+	ErrorUnknown:          "unknown error",
+	ErrorInvalidRequest:   "invalid request",
+	ErrorAgentUnavailable: "agent unavailable",
+	ErrorAgentFailure:     "agent failure",
+	ErrorUnknownSession:   "unknown session",
+}
+
+func (code ErrorCode) String() string {
+	name, ok := errorCodes[code]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{ErrorCode %d}", code)
 }
 
 type Message struct {
-	From string `json:"from"`
-	To   string `json:"to"`
-	Data string `json:"data"`
+	Version  int       `json:"version"`
+	Kind     Kind      `json:"kind,omitempty"`
+	ID       string    `json:"id,omitempty"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Agent    string    `json:"agent,omitempty"`
+	Channel  string    `json:"channel,omitempty"`
+	AckID    string    `json:"ackID,omitempty"`
+	Deadline time.Time `json:"deadline"`
+	Code     ErrorCode `json:"code,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Data     string    `json:"data"`
+}
+
+// MessageKind returns the message kind. Messages without kind are
+// data messages.
+func (m *Message) MessageKind() Kind {
+	if len(m.Kind) == 0 {
+		return KindData
+	}
+	return m.Kind
+}
+
+// Expired tests if the message's deadline has passed at the time
+// now. Messages without a deadline never expire.
+func (m *Message) Expired(now time.Time) bool {
+	return !m.Deadline.IsZero() && now.After(m.Deadline)
 }
 
 func (m *Message) Bytes() ([]byte, error) {
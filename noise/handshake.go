@@ -0,0 +1,152 @@
+//
+// handshake.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package noise
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	flynn "github.com/flynn/noise"
+)
+
+// Handshake implements the IK handshake pattern:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+//
+// The initiator knows the responder's static public key before the
+// handshake. The responder learns the initiator's static public key
+// from the first handshake message.
+type Handshake struct {
+	initiator bool
+	config    flynn.Config
+	state     *flynn.HandshakeState
+	send      *flynn.CipherState
+	recv      *flynn.CipherState
+	rand      io.Reader
+}
+
+// NewInitiator creates the initiator side of the handshake with the
+// responder's static public key. Both sides must use the same
+// prologue.
+func NewInitiator(static *KeyPair, remoteStatic [KeyLen]byte,
+	prologue []byte) *Handshake {
+
+	return &Handshake{
+		initiator: true,
+		config: flynn.Config{
+			CipherSuite:   cipherSuite,
+			Pattern:       flynn.HandshakeIK,
+			Initiator:     true,
+			Prologue:      prologue,
+			StaticKeypair: static.dhKey(),
+			PeerStatic:    append([]byte(nil), remoteStatic[:]...),
+		},
+		rand: rand.Reader,
+	}
+}
+
+// NewResponder creates the responder side of the handshake.
+func NewResponder(static *KeyPair, prologue []byte) *Handshake {
+	return &Handshake{
+		config: flynn.Config{
+			CipherSuite:   cipherSuite,
+			Pattern:       flynn.HandshakeIK,
+			Prologue:      prologue,
+			StaticKeypair: static.dhKey(),
+		},
+		rand: rand.Reader,
+	}
+}
+
+// handshakeState returns the handshake state. The state is created
+// on first use so that it uses the handshake's current random source.
+func (hs *Handshake) handshakeState() (*flynn.HandshakeState, error) {
+	if hs.state == nil {
+		config := hs.config
+		config.Random = hs.rand
+		state, err := flynn.NewHandshakeState(config)
+		if err != nil {
+			return nil, err
+		}
+		hs.state = state
+	}
+	return hs.state, nil
+}
+
+// RemoteStatic returns the static public key of the remote party.
+func (hs *Handshake) RemoteStatic() [KeyLen]byte {
+	var key [KeyLen]byte
+
+	peer := hs.config.PeerStatic
+	if hs.state != nil {
+		peer = hs.state.PeerStatic()
+	}
+	copy(key[:], peer)
+	return key
+}
+
+// Complete tests if the handshake is complete.
+func (hs *Handshake) Complete() bool {
+	return hs.send != nil
+}
+
+// WriteMessage creates the next handshake message with the payload.
+func (hs *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	state, err := hs.handshakeState()
+	if err != nil {
+		return nil, err
+	}
+	msg, cs1, cs2, err := state.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+	hs.split(cs1, cs2)
+	return msg, nil
+}
+
+// ReadMessage processes the next handshake message and returns its
+// payload.
+func (hs *Handshake) ReadMessage(msg []byte) ([]byte, error) {
+	state, err := hs.handshakeState()
+	if err != nil {
+		return nil, err
+	}
+	payload, cs1, cs2, err := state.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.split(cs1, cs2)
+	return payload, nil
+}
+
+// split sets the cipher states of the transport when the handshake's
+// last message returns them. The first cipher state encrypts the
+// initiator's messages.
+func (hs *Handshake) split(cs1, cs2 *flynn.CipherState) {
+	if cs1 == nil || cs2 == nil {
+		return
+	}
+	if hs.initiator {
+		hs.send, hs.recv = cs1, cs2
+	} else {
+		hs.send, hs.recv = cs2, cs1
+	}
+}
+
+// Transport returns the transport for the completed handshake.
+func (hs *Handshake) Transport() (*Transport, error) {
+	if !hs.Complete() {
+		return nil, errors.New("noise: handshake not complete")
+	}
+	return newTransport(hs.send.Cipher(), hs.recv.Cipher()), nil
+}
@@ -0,0 +1,79 @@
+//
+// noise.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+// Package noise implements the Noise IK handshake pattern with the
+// Noise_IK_25519_ChaChaPoly_SHA256 protocol, and a transport for
+// messages that can be delivered out of order. The handshake is
+// implemented with the github.com/flynn/noise package.
+package noise
+
+import (
+	"errors"
+	"io"
+
+	flynn "github.com/flynn/noise"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// ProtocolName is the Noise protocol name.
+	ProtocolName = "Noise_IK_25519_ChaChaPoly_SHA256"
+
+	// KeyLen specifies the length of the public and private keys.
+	KeyLen = 32
+
+	tagLen = chacha20poly1305.Overhead
+)
+
+var (
+	// ErrDecrypt is returned when a message fails authentication.
+	ErrDecrypt = errors.New("noise: message authentication failed")
+)
+
+// cipherSuite is the cipher suite of the protocol.
+var cipherSuite = flynn.NewCipherSuite(flynn.DH25519, flynn.CipherChaChaPoly,
+	flynn.HashSHA256)
+
+// KeyPair implements an X25519 key pair.
+type KeyPair struct {
+	Public  [KeyLen]byte
+	Private [KeyLen]byte
+}
+
+// GenerateKeyPair creates a new random key pair.
+func GenerateKeyPair(r io.Reader) (*KeyPair, error) {
+	key, err := flynn.DH25519.GenerateKeypair(r)
+	if err != nil {
+		return nil, err
+	}
+	kp := new(KeyPair)
+	copy(kp.Public[:], key.Public)
+	copy(kp.Private[:], key.Private)
+	return kp, nil
+}
+
+// NewKeyPair creates the key pair for the private key.
+func NewKeyPair(private [KeyLen]byte) (*KeyPair, error) {
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{
+		Private: private,
+	}
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+func (kp *KeyPair) dhKey() flynn.DHKey {
+	return flynn.DHKey{
+		Private: kp.Private[:],
+		Public:  kp.Public[:],
+	}
+}
@@ -0,0 +1,399 @@
+//
+// noise_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func seqKey(start byte) [KeyLen]byte {
+	var key [KeyLen]byte
+	for i := range key {
+		key[i] = start + byte(i)
+	}
+	return key
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func mustKeyPair(t *testing.T) *KeyPair {
+	kp, err := GenerateKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+// handshake runs the handshake and returns the initiator's and
+// responder's transports.
+func handshake(t *testing.T, init, resp *Handshake) (*Transport, *Transport) {
+	msg, err := init.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := resp.ReadMessage(msg)
+	if err != nil {
+		t.Fatalf("responder ReadMessage: %s", err)
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("responder payload %q", payload)
+	}
+	msg, err = resp.WriteMessage([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err = init.ReadMessage(msg)
+	if err != nil {
+		t.Fatalf("initiator ReadMessage: %s", err)
+	}
+	if string(payload) != "world" {
+		t.Fatalf("initiator payload %q", payload)
+	}
+	if !init.Complete() || !resp.Complete() {
+		t.Fatal("handshake not complete")
+	}
+	it, err := init.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := resp.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return it, rt
+}
+
+// TestVector checks the handshake and transport messages against
+// Noise_IK_25519_ChaChaPoly_SHA256 messages created with
+// github.com/flynn/noise with the same keys.
+func TestVector(t *testing.T) {
+	is, err := NewKeyPair(seqKey(0x01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewKeyPair(seqKey(0x21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ie := seqKey(0x41)
+	re := seqKey(0x61)
+	prologue := []byte("authorizer test vector")
+
+	if hex.EncodeToString(is.Public[:]) !=
+		"07a37cbc142093c8b755dc1b10e86cb426374ad16aa853ed0bdfc0b2b86d1c7c" {
+		t.Fatalf("initiator public key %x", is.Public)
+	}
+	if hex.EncodeToString(rs.Public[:]) !=
+		"5869aff450549732cbaaed5e5df9b30a6da31cb0e5742bad5ad4a1a768f1a67b" {
+		t.Fatalf("responder public key %x", rs.Public)
+	}
+
+	init := NewInitiator(is, rs.Public, prologue)
+	init.rand = bytes.NewReader(ie[:])
+	resp := NewResponder(rs, prologue)
+	resp.rand = bytes.NewReader(re[:])
+
+	m1, err := init.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustHex(t, "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d4846646a29af5ec4483a759c3537de9d8be0e9de3f950dcde27a868221e1ede553a693554916964aba4f2c7356d88872c590c1bc7f618b5a6c20e35ec0e2952bf96b1279e898eea")
+	if !bytes.Equal(m1, expected) {
+		t.Fatalf("message 1:\ngot  %x\nwant %x", m1, expected)
+	}
+	payload, err := resp.ReadMessage(m1)
+	if err != nil || string(payload) != "hello" {
+		t.Fatalf("responder ReadMessage: %q %v", payload, err)
+	}
+	if resp.RemoteStatic() != is.Public {
+		t.Fatalf("responder remote static %x", resp.RemoteStatic())
+	}
+
+	m2, err := resp.WriteMessage([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = mustHex(t, "244fe3b963e899dd295baffce248d3530f3a9a7479ba063002680ebfe7adad4989ce496bf8d9dab2c8a84fd2d97aad296164ff7534")
+	if !bytes.Equal(m2, expected) {
+		t.Fatalf("message 2:\ngot  %x\nwant %x", m2, expected)
+	}
+	payload, err = init.ReadMessage(m2)
+	if err != nil || string(payload) != "world" {
+		t.Fatalf("initiator ReadMessage: %q %v", payload, err)
+	}
+
+	it, err := init.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := resp.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transport messages carry the explicit nonce before the
+	// ciphertext.
+	c1, err := it.Seal([]byte("ad"), []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = mustHex(t, "000000000000000096cb073d8d78a571c7077e85a1a7a9736cc86ab5")
+	if !bytes.Equal(c1, expected) {
+		t.Fatalf("initiator transport:\ngot  %x\nwant %x", c1, expected)
+	}
+	c2, err := rt.Seal([]byte("ad"), []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = mustHex(t, "0000000000000000342f43c7a08b65d4ecc1edb28b6e57dbe5150273")
+	if !bytes.Equal(c2, expected) {
+		t.Fatalf("responder transport:\ngot  %x\nwant %x", c2, expected)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	is := mustKeyPair(t)
+	rs := mustKeyPair(t)
+
+	init := NewInitiator(is, rs.Public, []byte("prologue"))
+	resp := NewResponder(rs, []byte("prologue"))
+	it, rt := handshake(t, init, resp)
+
+	if init.RemoteStatic() != rs.Public {
+		t.Errorf("initiator remote static %x", init.RemoteStatic())
+	}
+	if resp.RemoteStatic() != is.Public {
+		t.Errorf("responder remote static %x", resp.RemoteStatic())
+	}
+
+	for i := 0; i < 10; i++ {
+		msg, err := it.Seal([]byte("ad"), []byte("request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rt.Open([]byte("ad"), msg)
+		if err != nil || string(data) != "request" {
+			t.Fatalf("responder Open: %q %v", data, err)
+		}
+		msg, err = rt.Seal(nil, []byte("response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = it.Open(nil, msg)
+		if err != nil || string(data) != "response" {
+			t.Fatalf("initiator Open: %q %v", data, err)
+		}
+	}
+
+	// The directions use different keys.
+	msg, err := it.Seal(nil, []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = it.Open(nil, msg)
+	if err != ErrDecrypt {
+		t.Errorf("reflected message: %v", err)
+	}
+}
+
+func TestHandshakeTamper(t *testing.T) {
+	is := mustKeyPair(t)
+	rs := mustKeyPair(t)
+
+	init := NewInitiator(is, rs.Public, nil)
+	m1, err := init.WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m1 {
+		tampered := append([]byte(nil), m1...)
+		tampered[i] ^= 0x01
+		_, err = NewResponder(rs, nil).ReadMessage(tampered)
+		if err == nil {
+			t.Fatalf("message 1 byte %d tamper not detected", i)
+		}
+	}
+	_, err = NewResponder(rs, nil).ReadMessage(m1[:len(m1)-1])
+	if err == nil {
+		t.Fatal("truncated message 1 accepted")
+	}
+
+	// Each tampered message 2 is created with a fresh handshake.
+	for i := 0; ; i++ {
+		init := NewInitiator(is, rs.Public, nil)
+		m1, err := init.WriteMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := NewResponder(rs, nil)
+		_, err = resp.ReadMessage(m1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, err := resp.WriteMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(m2) {
+			break
+		}
+		m2[i] ^= 0x01
+		_, err = init.ReadMessage(m2)
+		if err == nil {
+			t.Fatalf("message 2 byte %d tamper not detected", i)
+		}
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	is := mustKeyPair(t)
+	rs := mustKeyPair(t)
+	other := mustKeyPair(t)
+
+	// The initiator expects another responder.
+	m1, err := NewInitiator(is, other.Public, nil).WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewResponder(rs, nil).ReadMessage(m1)
+	if err == nil {
+		t.Error("wrong responder key accepted")
+	}
+
+	// Prologues differ.
+	m1, err = NewInitiator(is, rs.Public, []byte("a")).WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewResponder(rs, []byte("b")).ReadMessage(m1)
+	if err == nil {
+		t.Error("prologue mismatch accepted")
+	}
+
+	// Out of order operations.
+	resp := NewResponder(rs, nil)
+	_, err = resp.WriteMessage(nil)
+	if err == nil {
+		t.Error("responder wrote first")
+	}
+	_, err = resp.Transport()
+	if err == nil {
+		t.Error("transport before handshake")
+	}
+}
+
+func newTransports(t *testing.T) (*Transport, *Transport) {
+	rs := mustKeyPair(t)
+	return handshake(t, NewInitiator(mustKeyPair(t), rs.Public, nil),
+		NewResponder(rs, nil))
+}
+
+func TestTransportTamper(t *testing.T) {
+	it, rt := newTransports(t)
+
+	msg, err := it.Seal([]byte("ad"), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range msg {
+		tampered := append([]byte(nil), msg...)
+		tampered[i] ^= 0x01
+		_, err = rt.Open([]byte("ad"), tampered)
+		if err != ErrDecrypt {
+			t.Fatalf("byte %d tamper: %v", i, err)
+		}
+	}
+	_, err = rt.Open([]byte("other"), msg)
+	if err != ErrDecrypt {
+		t.Errorf("additional data mismatch: %v", err)
+	}
+	_, err = rt.Open([]byte("ad"), msg[:len(msg)-1])
+	if err != ErrDecrypt {
+		t.Errorf("truncated message: %v", err)
+	}
+	_, err = rt.Open([]byte("ad"), msg[:7])
+	if err != ErrDecrypt {
+		t.Errorf("truncated nonce: %v", err)
+	}
+
+	// The failed attempts do not consume the nonce.
+	data, err := rt.Open([]byte("ad"), msg)
+	if err != nil || string(data) != "data" {
+		t.Errorf("Open: %q %v", data, err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	it, rt := newTransports(t)
+
+	var msgs [][]byte
+	for i := 0; i < ReplayWindow+10; i++ {
+		msg, err := it.Seal(nil, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// Messages can arrive in any order.
+	for _, i := range []int{3, 1, 2, 0} {
+		_, err := rt.Open(nil, msgs[i])
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{0, 1, 2, 3} {
+		_, err := rt.Open(nil, msgs[i])
+		if err != ErrReplay {
+			t.Fatalf("replayed message %d: %v", i, err)
+		}
+	}
+
+	// Advance the window past the unseen messages.
+	last := len(msgs) - 1
+	_, err := rt.Open(nil, msgs[last])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rt.Open(nil, msgs[last])
+	if err != ErrReplay {
+		t.Errorf("replayed latest message: %v", err)
+	}
+
+	// Messages older than the window are rejected even if they were
+	// never seen.
+	_, err = rt.Open(nil, msgs[last-ReplayWindow])
+	if err != ErrReplay {
+		t.Errorf("message below the window: %v", err)
+	}
+	_, err = rt.Open(nil, msgs[4])
+	if err != ErrReplay {
+		t.Errorf("old message: %v", err)
+	}
+
+	// Unseen messages inside the window are accepted once.
+	i := last - ReplayWindow + 1
+	_, err = rt.Open(nil, msgs[i])
+	if err != nil {
+		t.Errorf("message at the window edge: %v", err)
+	}
+	_, err = rt.Open(nil, msgs[i])
+	if err != ErrReplay {
+		t.Errorf("replayed message at the window edge: %v", err)
+	}
+}
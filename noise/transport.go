@@ -0,0 +1,89 @@
+//
+// transport.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	flynn "github.com/flynn/noise"
+)
+
+// ReplayWindow specifies how many of the latest message nonces are
+// remembered for detecting replayed messages.
+const ReplayWindow = 1024
+
+var (
+	// ErrReplay is returned when a message is replayed or it is too
+	// old to be checked for replays.
+	ErrReplay = errors.New("noise: replayed message")
+)
+
+// Transport encrypts and decrypts messages after the handshake. The
+// messages carry their nonces so they can be decrypted in any order.
+// Transport is safe for concurrent use.
+type Transport struct {
+	send flynn.Cipher
+	recv flynn.Cipher
+
+	m       sync.Mutex
+	n       uint64
+	highest uint64
+	seen    [ReplayWindow]uint64
+}
+
+func newTransport(send, recv flynn.Cipher) *Transport {
+	return &Transport{
+		send: send,
+		recv: recv,
+	}
+}
+
+// Seal encrypts and authenticates the plaintext and authenticates the
+// additional data.
+func (t *Transport) Seal(ad, plaintext []byte) ([]byte, error) {
+	t.m.Lock()
+	n := t.n
+	t.n++
+	t.m.Unlock()
+
+	if n == ^uint64(0) {
+		return nil, errors.New("noise: nonce exhausted")
+	}
+	msg := make([]byte, 8, 8+len(plaintext)+tagLen)
+	binary.BigEndian.PutUint64(msg, n)
+	return t.send.Encrypt(msg, n, ad, plaintext), nil
+}
+
+// Open decrypts and authenticates the message and authenticates the
+// additional data.
+func (t *Transport) Open(ad, msg []byte) ([]byte, error) {
+	if len(msg) < 8+tagLen {
+		return nil, ErrDecrypt
+	}
+	n := binary.BigEndian.Uint64(msg)
+	plaintext, err := t.recv.Decrypt(nil, n, ad, msg[8:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// The window slots hold nonce+1 so that zero marks an empty slot.
+	if n+ReplayWindow <= t.highest || t.seen[n%ReplayWindow] == n+1 {
+		return nil, ErrReplay
+	}
+	t.seen[n%ReplayWindow] = n + 1
+	if n > t.highest {
+		t.highest = n
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,154 @@
+//
+// relay.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/markkurossi/authorizer/authn"
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
+)
+
+const (
+	// ScopeAdmin grants access to all clients and agents, and to the
+	// relay maintenance operations.
+	ScopeAdmin = "admin"
+
+	// ScopeClientConnect grants access to create client sessions and
+	// to list agents.
+	ScopeClientConnect = "client:connect"
+
+	// ScopeAgentServe grants access to register and serve any agent.
+	// The scope "agent:serve:{ID}" grants access to the agent ID only.
+	ScopeAgentServe = "agent:serve"
+)
+
+// Relay implements the "/agents" and "/clients" REST API on top of a
+// message broker.
+type Relay struct {
+	broker      broker.Broker
+	store       store.Store
+	authn       authn.Authenticator
+	clientLease time.Duration
+	mux         *http.ServeMux
+}
+
+// NewRelay creates a new relay that passes messages with the broker,
+// keeps its state in the store, and authenticates requests with the
+// authenticator.
+func NewRelay(b broker.Broker, s store.Store,
+	authenticator authn.Authenticator) *Relay {
+
+	relay := &Relay{
+		broker:      b,
+		store:       s,
+		authn:       authenticator,
+		clientLease: ClientLease,
+		mux:         http.NewServeMux(),
+	}
+	relay.mux.HandleFunc("/agents", relay.Agents)
+	relay.mux.HandleFunc("/agents/", relay.Agent)
+	relay.mux.HandleFunc("/clients", relay.Clients)
+	relay.mux.HandleFunc("/clients/", relay.Client)
+	relay.mux.HandleFunc("/sweep", relay.SweepHandler)
+
+	return relay
+}
+
+// SetClientLease sets the lease duration of new client sessions.
+// Clients must renew their sessions within the lease or the sessions
+// expire. A non-positive lease disables leases. The lease is reported
+// to the clients in seconds so positive leases must be at least one
+// second.
+func (relay *Relay) SetClientLease(lease time.Duration) error {
+	if lease > 0 && lease < time.Second {
+		return fmt.Errorf("client lease %s shorter than one second", lease)
+	}
+	relay.clientLease = lease
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (relay *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	relay.mux.ServeHTTP(w, r)
+}
+
+// agentScope returns the scope that grants access to serve the agent.
+func agentScope(agentID string) string {
+	return ScopeAgentServe + ":" + agentID
+}
+
+// hasScope tests if the principal has any of the scopes. The admin
+// scope grants all scopes.
+func hasScope(principal *authn.Principal, scopes ...string) bool {
+	if principal.HasScope(ScopeAdmin) {
+		return true
+	}
+	for _, scope := range scopes {
+		if principal.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireScope tests if the principal has any of the scopes. If not,
+// requireScope writes an error response and returns false.
+func requireScope(w http.ResponseWriter, principal *authn.Principal,
+	scopes ...string) bool {
+
+	if hasScope(principal, scopes...) {
+		return true
+	}
+	Errorf(w, http.StatusForbidden, "Insufficient scope, requires %s",
+		scopes[0])
+	return false
+}
+
+// authorized tests if the principal can access objects owned by the
+// subject.
+func authorized(principal *authn.Principal, subject string) bool {
+	return principal.Subject == subject || principal.HasScope(ScopeAdmin)
+}
+
+// ack handles message acknowledgements to the queue.
+func (relay *Relay) ack(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, queue string) {
+
+	if r.Method != "POST" {
+		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Error500f(w, "ioutil.ReadAll: %s", err)
+		return
+	}
+	req := new(AckRequest)
+	err = json.Unmarshal(data, req)
+	if err != nil {
+		Errorf(w, http.StatusBadRequest, "Invalid request data: %s", err)
+		return
+	}
+	err = relay.broker.Ack(ctx, queue, req.AckID)
+	if err == broker.ErrInvalidAckID {
+		Errorf(w, http.StatusGone, "Lease expired")
+		return
+	} else if err != nil {
+		Error500f(w, "Ack: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,687 @@
+//
+// relay_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/markkurossi/authorizer/authn"
+	"github.com/markkurossi/authorizer/broker"
+	"github.com/markkurossi/authorizer/store"
+)
+
+// Test principals. The API keys are named after their principals.
+var testKeys = []authn.APIKey{
+	{
+		Key:     "alice",
+		Subject: "alice",
+		Scopes:  []string{ScopeClientConnect},
+	},
+	{
+		Key:     "alice-agent",
+		Subject: "alice",
+		Scopes:  []string{ScopeAgentServe},
+	},
+	{
+		Key:     "bob",
+		Subject: "bob",
+		Scopes:  []string{ScopeClientConnect},
+	},
+	{
+		Key:     "bob-agent",
+		Subject: "bob",
+		Scopes:  []string{ScopeAgentServe},
+	},
+	{
+		Key:     "admin",
+		Subject: "admin",
+		Scopes:  []string{ScopeAdmin},
+	},
+}
+
+type testRelay struct {
+	t      *testing.T
+	relay  *Relay
+	broker broker.Broker
+	store  store.Store
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	authenticator, err := authn.NewAPIKeys("test", testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := broker.NewMemory()
+	s := store.NewMemory()
+	return &testRelay{
+		t:      t,
+		relay:  NewRelay(b, s, authenticator),
+		broker: b,
+		store:  s,
+	}
+}
+
+// request describes a test request to the relay.
+type request struct {
+	key            string
+	method         string
+	path           string
+	body           interface{}
+	idempotencyKey string
+	timeout        time.Duration
+}
+
+// do sends the request to the relay and decodes the response into
+// result if it is not nil. The long-polling requests are bounded by
+// the request timeout.
+func (tr *testRelay) do(req request, result interface{}) int {
+	var body []byte
+	if req.body != nil {
+		var err error
+		body, err = json.Marshal(req.body)
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+	}
+	timeout := req.timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r := httptest.NewRequest(req.method, req.path, bytes.NewReader(body))
+	r = r.WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+req.key)
+	if len(req.idempotencyKey) > 0 {
+		r.Header.Set(IdempotencyKeyHeader, req.idempotencyKey)
+	}
+	w := httptest.NewRecorder()
+	tr.relay.ServeHTTP(w, r)
+
+	if result != nil && w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), result)
+		if err != nil {
+			tr.t.Fatalf("%s %s: invalid response: %s", req.method, req.path,
+				err)
+		}
+	}
+	return w.Code
+}
+
+// expect sends the request and checks the response status.
+func (tr *testRelay) expect(status int, req request, result interface{}) {
+	tr.t.Helper()
+	code := tr.do(req, result)
+	if code != status {
+		tr.t.Fatalf("%s %s as %s: status %d, expected %d", req.method,
+			req.path, req.key, code, status)
+	}
+}
+
+// registerAgent registers the agent with the principal's key.
+func (tr *testRelay) registerAgent(key, id string) {
+	tr.t.Helper()
+	result := new(ServerConnectResult)
+	tr.expect(http.StatusOK, request{
+		key:    key,
+		method: "POST",
+		path:   "/agents",
+		body: &ServerConnectRequest{
+			ID: id,
+		},
+	}, result)
+	if result.ID != id || result.URL != "/agents/"+id {
+		tr.t.Fatalf("registered agent %s at %s", result.ID, result.URL)
+	}
+}
+
+// connect creates a client session for the agents.
+func (tr *testRelay) connect(key string, agents ...string) *ClientConnectResult {
+	tr.t.Helper()
+	result := new(ClientConnectResult)
+	tr.expect(http.StatusOK, request{
+		key:    key,
+		method: "POST",
+		path:   "/clients",
+		body: &ClientConnectRequest{
+			Agents: agents,
+		},
+	}, result)
+	return result
+}
+
+// newRequest creates a data request from the client session.
+func newRequest(client *ClientConnectResult, id, data string) *Message {
+	msg := &Message{
+		Version: ProtocolVersion,
+		ID:      id,
+		From:    client.ID,
+		Channel: "channel",
+	}
+	msg.SetBytes([]byte(data))
+	return msg
+}
+
+// newResponse creates the agent's response to the request.
+func newResponse(req *Message, data string) *Message {
+	msg := &Message{
+		Version: ProtocolVersion,
+		ID:      req.ID,
+		To:      req.From,
+		Channel: req.Channel,
+	}
+	msg.SetBytes([]byte(data))
+	return msg
+}
+
+func messageData(t *testing.T, msg *Message) string {
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRelayAgents(t *testing.T) {
+	tr := newTestRelay(t)
+
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "POST",
+		path:   "/agents",
+		body: &ServerConnectRequest{
+			ID:   "laptop",
+			Name: "Laptop",
+			Identities: []*Identity{
+				{
+					Key:     []byte("key"),
+					Comment: "alice@laptop",
+				},
+			},
+		},
+	}, nil)
+
+	// A relay assigned agent ID.
+	result := new(ServerConnectResult)
+	tr.expect(http.StatusOK, request{
+		key:    "bob-agent",
+		method: "POST",
+		path:   "/agents",
+	}, result)
+	if !reAgentID.MatchString(result.ID) {
+		t.Errorf("invalid assigned agent ID '%s'", result.ID)
+	}
+
+	// Only the owner can register and serve the agent.
+	tr.expect(http.StatusForbidden, request{
+		key:    "bob-agent",
+		method: "POST",
+		path:   "/agents",
+		body: &ServerConnectRequest{
+			ID: "laptop",
+		},
+	}, nil)
+	tr.expect(http.StatusForbidden, request{
+		key:    "bob-agent",
+		method: "PUT",
+		path:   "/agents/laptop",
+	}, nil)
+	tr.expect(http.StatusForbidden, request{
+		key:    "alice",
+		method: "POST",
+		path:   "/agents",
+		body: &ServerConnectRequest{
+			ID: "desktop",
+		},
+	}, nil)
+
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "PUT",
+		path:   "/agents/laptop",
+		body: &AgentStatus{
+			Available: false,
+		},
+	}, nil)
+
+	list := new(AgentList)
+	tr.expect(http.StatusOK, request{
+		key:    "bob",
+		method: "GET",
+		path:   "/agents",
+	}, list)
+	if len(list.Agents) != 2 {
+		t.Fatalf("%d agents listed, expected 2", len(list.Agents))
+	}
+	info := new(AgentInfo)
+	tr.expect(http.StatusOK, request{
+		key:    "bob",
+		method: "GET",
+		path:   "/agents/laptop/info",
+	}, info)
+	if info.Name != "Laptop" || !info.Online || info.Available ||
+		len(info.Fingerprints) != 1 {
+		t.Errorf("unexpected agent info: %+v", info)
+	}
+	tr.expect(http.StatusNotFound, request{
+		key:    "bob",
+		method: "GET",
+		path:   "/agents/unknown/info",
+	}, nil)
+	tr.expect(http.StatusForbidden, request{
+		key:    "alice-agent",
+		method: "GET",
+		path:   "/agents",
+	}, nil)
+}
+
+func TestRelaySession(t *testing.T) {
+	tr := newTestRelay(t)
+	tr.registerAgent("alice-agent", "laptop")
+
+	client := tr.connect("alice", "laptop")
+	if client.Agent != "laptop" || client.Lease != int(ClientLease/time.Second) {
+		t.Fatalf("unexpected session: %+v", client)
+	}
+	tr.expect(http.StatusNotFound, request{
+		key:    "alice",
+		method: "POST",
+		path:   "/clients",
+		body: &ClientConnectRequest{
+			Agent: "unknown",
+		},
+	}, nil)
+
+	// The session is accessible only by its subject.
+	tr.expect(http.StatusForbidden, request{
+		key:    "bob",
+		method: "PUT",
+		path:   client.URL,
+	}, nil)
+	tr.expect(http.StatusOK, request{
+		key:    "alice",
+		method: "PUT",
+		path:   client.URL,
+	}, nil)
+
+	// The client's request waits for the agent's response.
+	type result struct {
+		status int
+		msg    *Message
+	}
+	done := make(chan result)
+	go func() {
+		msg := new(Message)
+		status := tr.do(request{
+			key:    "alice",
+			method: "POST",
+			path:   client.URL,
+			body:   newRequest(client, "1", "request"),
+		}, msg)
+		done <- result{status, msg}
+	}()
+
+	req := new(Message)
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "GET",
+		path:   "/agents/laptop",
+	}, req)
+	if req.From != client.ID || req.ID != "1" ||
+		messageData(t, req) != "request" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "POST",
+		path:   "/agents/laptop/ack",
+		body: &AckRequest{
+			AckID: req.AckID,
+		},
+	}, nil)
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "POST",
+		path:   "/agents/laptop",
+		body:   newResponse(req, "response"),
+	}, nil)
+
+	r := <-done
+	if r.status != http.StatusOK || r.msg.ID != "1" ||
+		messageData(t, r.msg) != "response" {
+		t.Fatalf("unexpected response %d: %+v", r.status, r.msg)
+	}
+	tr.expect(http.StatusOK, request{
+		key:    "alice",
+		method: "POST",
+		path:   client.URL + "/ack",
+		body: &AckRequest{
+			AckID: r.msg.AckID,
+		},
+	}, nil)
+	tr.expect(http.StatusGone, request{
+		key:    "alice",
+		method: "POST",
+		path:   client.URL + "/ack",
+		body: &AckRequest{
+			AckID: r.msg.AckID,
+		},
+	}, nil)
+
+	// Closing the session notifies the agent.
+	tr.expect(http.StatusOK, request{
+		key:    "alice",
+		method: "DELETE",
+		path:   client.URL,
+	}, nil)
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "GET",
+		path:   "/agents/laptop",
+	}, req)
+	if req.Kind != KindClose || req.From != client.ID {
+		t.Errorf("unexpected close message: %+v", req)
+	}
+	tr.expect(http.StatusNotFound, request{
+		key:    "alice",
+		method: "GET",
+		path:   client.URL,
+	}, nil)
+}
+
+func TestRelayIdempotency(t *testing.T) {
+	tr := newTestRelay(t)
+	tr.registerAgent("alice-agent", "laptop")
+
+	connect := func(key, idempotencyKey string) *ClientConnectResult {
+		result := new(ClientConnectResult)
+		tr.expect(http.StatusOK, request{
+			key:    key,
+			method: "POST",
+			path:   "/clients",
+			body: &ClientConnectRequest{
+				Agent: "laptop",
+			},
+			idempotencyKey: idempotencyKey,
+		}, result)
+		return result
+	}
+
+	// Retried session creations get the same session.
+	first := connect("alice", "connect-1")
+	if retry := connect("alice", "connect-1"); retry.ID != first.ID {
+		t.Errorf("retried connect created session %s, expected %s",
+			retry.ID, first.ID)
+	}
+	if other := connect("alice", "connect-2"); other.ID == first.ID {
+		t.Errorf("different idempotency keys created the same session")
+	}
+	if other := connect("bob", "connect-1"); other.ID == first.ID {
+		t.Errorf("subjects share idempotency keys")
+	}
+	tr.expect(http.StatusBadRequest, request{
+		key:            "alice",
+		method:         "POST",
+		path:           "/clients",
+		body:           &ClientConnectRequest{Agent: "laptop"},
+		idempotencyKey: "invalid key",
+	}, nil)
+
+	// Retried requests are delivered once. The requests time out
+	// since the agent does not respond.
+	for i := 0; i < 2; i++ {
+		tr.expect(http.StatusAccepted, request{
+			key:            "alice",
+			method:         "POST",
+			path:           first.URL,
+			body:           newRequest(first, "1", "request"),
+			idempotencyKey: "request-1",
+			timeout:        10 * time.Millisecond,
+		}, nil)
+	}
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "GET",
+		path:   "/agents/laptop",
+	}, nil)
+	tr.expect(http.StatusRequestTimeout, request{
+		key:     "alice-agent",
+		method:  "GET",
+		path:    "/agents/laptop",
+		timeout: 10 * time.Millisecond,
+	}, nil)
+}
+
+func TestRelayAgentIdempotency(t *testing.T) {
+	tr := newTestRelay(t)
+
+	register := func(key, idempotencyKey string) *ServerConnectResult {
+		result := new(ServerConnectResult)
+		tr.expect(http.StatusOK, request{
+			key:            key,
+			method:         "POST",
+			path:           "/agents",
+			body:           &ServerConnectRequest{Name: "laptop"},
+			idempotencyKey: idempotencyKey,
+		}, result)
+		return result
+	}
+
+	// Retried registrations get the same agent.
+	first := register("alice-agent", "register-1")
+	if retry := register("alice-agent", "register-1"); retry.ID != first.ID {
+		t.Errorf("retried registration created agent %s, expected %s",
+			retry.ID, first.ID)
+	}
+	if other := register("alice-agent", "register-2"); other.ID == first.ID {
+		t.Errorf("different idempotency keys created the same agent")
+	}
+	if other := register("bob-agent", "register-1"); other.ID == first.ID {
+		t.Errorf("subjects share idempotency keys")
+	}
+	if other := register("alice-agent", ""); other.ID == first.ID {
+		t.Errorf("registration without idempotency key reused agent")
+	}
+	tr.expect(http.StatusBadRequest, request{
+		key:            "alice-agent",
+		method:         "POST",
+		path:           "/agents",
+		body:           &ServerConnectRequest{Name: "laptop"},
+		idempotencyKey: "invalid key",
+	}, nil)
+
+	list := new(AgentList)
+	tr.expect(http.StatusOK, request{
+		key:    "alice",
+		method: "GET",
+		path:   "/agents",
+	}, list)
+	if len(list.Agents) != 4 {
+		t.Errorf("%d agents registered, expected 4", len(list.Agents))
+	}
+}
+
+func TestRelaySweep(t *testing.T) {
+	tr := newTestRelay(t)
+	tr.registerAgent("alice-agent", "laptop")
+	ctx := context.Background()
+	now := time.Now()
+
+	err := tr.relay.SetClientLease(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := tr.connect("alice", "laptop")
+	active := tr.connect("alice", "laptop")
+
+	err = tr.relay.SetClientLease(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := tr.connect("alice", "laptop")
+	leased := tr.connect("alice", "laptop")
+
+	for _, c := range []struct {
+		id           string
+		lastActivity time.Time
+	}{
+		{idle.ID, now.Add(-2 * time.Hour)},
+		{active.ID, now.Add(-time.Minute)},
+		{expired.ID, now.Add(-2 * time.Minute)},
+	} {
+		err = tr.store.SetClientLastActivity(ctx, c.id, c.lastActivity)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr.expect(http.StatusForbidden, request{
+		key:    "alice",
+		method: "POST",
+		path:   "/sweep",
+	}, nil)
+	tr.expect(http.StatusBadRequest, request{
+		key:    "admin",
+		method: "POST",
+		path:   "/sweep?idle=invalid",
+	}, nil)
+
+	result := new(SweepResult)
+	tr.expect(http.StatusOK, request{
+		key:    "admin",
+		method: "POST",
+		path:   "/sweep",
+	}, result)
+	removed := make(map[string]bool)
+	for _, id := range result.Removed {
+		removed[id] = true
+	}
+	if len(removed) != 2 || !removed[idle.ID] || !removed[expired.ID] {
+		t.Fatalf("sweep removed %v, expected %s and %s", result.Removed,
+			idle.ID, expired.ID)
+	}
+	for _, client := range []*ClientConnectResult{idle, expired} {
+		tr.expect(http.StatusNotFound, request{
+			key:    "alice",
+			method: "PUT",
+			path:   client.URL,
+		}, nil)
+		id, err := ParseID(client.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.broker.Publish(ctx, clientQueue(id), &broker.Message{})
+		if err != broker.ErrQueueNotFound {
+			t.Errorf("queue of removed session %s: %v", client.ID, err)
+		}
+	}
+	for _, client := range []*ClientConnectResult{active, leased} {
+		tr.expect(http.StatusOK, request{
+			key:    "alice",
+			method: "PUT",
+			path:   client.URL,
+		}, nil)
+	}
+
+	// Sessions with an expired lease are removed when they are used.
+	err = tr.store.SetClientLastActivity(ctx, leased.ID,
+		now.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.expect(http.StatusGone, request{
+		key:    "alice",
+		method: "PUT",
+		path:   leased.URL,
+	}, nil)
+	tr.expect(http.StatusNotFound, request{
+		key:    "alice",
+		method: "PUT",
+		path:   leased.URL,
+	}, nil)
+}
+
+func TestRelayClientFrom(t *testing.T) {
+	tr := newTestRelay(t)
+	tr.registerAgent("bob-agent", "desktop")
+
+	alice := tr.connect("alice", "desktop")
+	bob := tr.connect("bob", "desktop")
+
+	// Bob cannot direct the agent's responses to Alice's session.
+	tr.expect(http.StatusForbidden, request{
+		key:    "bob",
+		method: "POST",
+		path:   bob.URL,
+		body:   newRequest(alice, "1", "request"),
+	}, nil)
+	tr.expect(http.StatusRequestTimeout, request{
+		key:     "bob-agent",
+		method:  "GET",
+		path:    "/agents/desktop",
+		timeout: 10 * time.Millisecond,
+	}, nil)
+}
+
+func TestRelayAgentResponse(t *testing.T) {
+	tr := newTestRelay(t)
+	tr.registerAgent("alice-agent", "laptop")
+	tr.registerAgent("bob-agent", "desktop")
+
+	client := tr.connect("alice", "laptop")
+	req := newRequest(client, "1", "request")
+
+	// Bob's agent cannot answer the requests of sessions that do not
+	// use it.
+	tr.expect(http.StatusForbidden, request{
+		key:    "bob-agent",
+		method: "POST",
+		path:   "/agents/desktop",
+		body:   newResponse(req, "forged"),
+	}, nil)
+	tr.expect(http.StatusRequestTimeout, request{
+		key:     "alice",
+		method:  "GET",
+		path:    client.URL,
+		timeout: 10 * time.Millisecond,
+	}, nil)
+
+	tr.expect(http.StatusNotFound, request{
+		key:    "bob-agent",
+		method: "POST",
+		path:   "/agents/desktop",
+		body: newResponse(&Message{
+			ID:   "1",
+			From: "00112233445566778899aabbccddeeff",
+		}, "response"),
+	}, nil)
+
+	tr.expect(http.StatusOK, request{
+		key:    "alice-agent",
+		method: "POST",
+		path:   "/agents/laptop",
+		body:   newResponse(req, "response"),
+	}, nil)
+	msg := new(Message)
+	tr.expect(http.StatusOK, request{
+		key:    "alice",
+		method: "GET",
+		path:   client.URL,
+	}, msg)
+	if messageData(t, msg) != "response" {
+		t.Errorf("unexpected response %q", messageData(t, msg))
+	}
+}
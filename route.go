@@ -0,0 +1,107 @@
+//
+// route.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	ssh "github.com/markkurossi/authorizer/secsh/agent"
+	"github.com/markkurossi/authorizer/store"
+)
+
+// route selects the agent that handles the client request. The
+// request is passed to the agent that advertised the request's key.
+// If the relay answers the request itself, route returns the
+// response message and an empty agent ID.
+func (relay *Relay) route(ctx context.Context, client *store.Client,
+	agentID string, payload []byte) (string, ssh.Message, error) {
+
+	if len(agentID) == 0 {
+		agentID = client.Agents[0]
+	}
+	if len(client.Agents) == 1 {
+		return agentID, nil, nil
+	}
+	msg, err := ssh.Wrap(payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch msg.Type() {
+	case ssh.SSH_AGENTC_REQUEST_IDENTITIES:
+		// Answer with the merged identities of all online client
+		// agents.
+		var ids []*ssh.Identity
+		now := time.Now()
+		for _, id := range client.Agents {
+			agent, err := relay.store.GetAgent(ctx, id)
+			if err == store.ErrNotFound {
+				continue
+			} else if err != nil {
+				return "", nil, err
+			}
+			if !agentOnline(agent, now) {
+				continue
+			}
+		identities:
+			for _, identity := range agent.Identities {
+				for _, old := range ids {
+					if bytes.Equal(old.Blob, identity.Key) {
+						continue identities
+					}
+				}
+				ids = append(ids, &ssh.Identity{
+					Blob:    identity.Key,
+					Comment: identity.Comment,
+				})
+			}
+		}
+		return "", ssh.NewIdentitiesAnswer(ids), nil
+
+	case ssh.SSH_AGENTC_SIGN_REQUEST:
+		req, err := ssh.ParseSignRequest(msg)
+		if err != nil {
+			return "", nil, err
+		}
+		fingerprint := ssh.Fingerprint(req.KeyBlob)
+		now := time.Now()
+		var offline string
+		for _, id := range client.Agents {
+			agent, err := relay.store.GetAgent(ctx, id)
+			if err == store.ErrNotFound {
+				continue
+			} else if err != nil {
+				return "", nil, err
+			}
+			for _, fp := range agent.Fingerprints {
+				if fp != fingerprint {
+					continue
+				}
+				if agentOnline(agent, now) {
+					return agent.ID, nil, nil
+				}
+				if len(offline) == 0 {
+					offline = agent.ID
+				}
+			}
+		}
+		if len(offline) > 0 {
+			// Only offline agents have the key. The caller reports
+			// the agent offline.
+			return offline, nil, nil
+		}
+		// No agent has the key.
+		return "", ssh.NewMessage(ssh.SSH_AGENT_FAILURE, nil), nil
+
+	default:
+		return agentID, nil, nil
+	}
+}
@@ -0,0 +1,146 @@
+//
+// identity.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Identity implements an SSH agent identity.
+type Identity struct {
+	Blob    []byte
+	Comment string
+}
+
+// Fingerprint returns the SHA256 fingerprint of the identity's public
+// key in the format used by ssh-keygen.
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.Blob)
+}
+
+// Fingerprint returns the SHA256 fingerprint of the public key blob.
+func Fingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// NewMessage creates a new agent message with the type and data.
+func NewMessage(t Type, data []byte) Message {
+	m := make([]byte, 5+len(data))
+	bo.PutUint32(m, uint32(1+len(data)))
+	m[4] = byte(t)
+	copy(m[5:], data)
+	return Message(m)
+}
+
+// NewIdentitiesAnswer creates a new SSH_AGENT_IDENTITIES_ANSWER
+// message for the identities.
+func NewIdentitiesAnswer(ids []*Identity) Message {
+	var data []byte
+
+	data = appendUint32(data, uint32(len(ids)))
+	for _, id := range ids {
+		data = appendString(data, id.Blob)
+		data = appendString(data, []byte(id.Comment))
+	}
+	return NewMessage(SSH_AGENT_IDENTITIES_ANSWER, data)
+}
+
+// ParseIdentitiesAnswer parses the SSH_AGENT_IDENTITIES_ANSWER
+// message.
+func ParseIdentitiesAnswer(m Message) ([]*Identity, error) {
+	if m.Type() != SSH_AGENT_IDENTITIES_ANSWER {
+		return nil, fmt.Errorf("Unexpected message %s", m.Type())
+	}
+	data := m.Data()
+	count, data, err := readUint32(data)
+	if err != nil {
+		return nil, err
+	}
+	var result []*Identity
+	for i := 0; i < int(count); i++ {
+		var blob, comment []byte
+
+		blob, data, err = readString(data)
+		if err != nil {
+			return nil, err
+		}
+		comment, data, err = readString(data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &Identity{
+			Blob:    blob,
+			Comment: string(comment),
+		})
+	}
+	return result, nil
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	var buf [4]byte
+	bo.PutUint32(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendString(data, str []byte) []byte {
+	data = appendUint32(data, uint32(len(str)))
+	return append(data, str...)
+}
+
+func readUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("Truncated message")
+	}
+	return bo.Uint32(data), data[4:], nil
+}
+
+func readString(data []byte) ([]byte, []byte, error) {
+	length, data, err := readUint32(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(data)) < length {
+		return nil, nil, fmt.Errorf("Truncated message")
+	}
+	return data[:length], data[length:], nil
+}
+
+// SignRequest implements the SSH_AGENTC_SIGN_REQUEST message.
+type SignRequest struct {
+	KeyBlob []byte
+	Data    []byte
+	Flags   uint32
+}
+
+// ParseSignRequest parses the SSH_AGENTC_SIGN_REQUEST message.
+func ParseSignRequest(m Message) (*SignRequest, error) {
+	if m.Type() != SSH_AGENTC_SIGN_REQUEST {
+		return nil, fmt.Errorf("Unexpected message %s", m.Type())
+	}
+	blob, data, err := readString(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	signData, data, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	flags, _, err := readUint32(data)
+	if err != nil {
+		return nil, err
+	}
+	return &SignRequest{
+		KeyBlob: blob,
+		Data:    signData,
+		Flags:   flags,
+	}, nil
+}
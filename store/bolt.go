@@ -0,0 +1,277 @@
+//
+// bolt.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketAgents  = []byte("agents")
+	bucketClients = []byte("clients")
+	bucketKeys    = []byte("idempotencyKeys")
+)
+
+// Bolt implements a Store that persists its state in a bbolt database
+// file.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens the bbolt database file path, creating it if it does
+// not exist, and returns a store that keeps its state in the
+// database.
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketAgents, bucketClients, bucketKeys} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{
+		db: db,
+	}, nil
+}
+
+func getJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// PutAgent implements Store.PutAgent.
+func (s *Bolt) PutAgent(ctx context.Context, agent *Agent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketAgents), agent.ID, agent)
+	})
+}
+
+// GetAgent implements Store.GetAgent.
+func (s *Bolt) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	agent := new(Agent)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketAgents), id, agent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// ListAgents implements Store.ListAgents.
+func (s *Bolt) ListAgents(ctx context.Context) ([]*Agent, error) {
+	var result []*Agent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAgents).ForEach(func(k, v []byte) error {
+			agent := new(Agent)
+			err := json.Unmarshal(v, agent)
+			if err != nil {
+				return err
+			}
+			result = append(result, agent)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetAgentLastSeen implements Store.SetAgentLastSeen.
+func (s *Bolt) SetAgentLastSeen(ctx context.Context, id string,
+	t time.Time) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAgents)
+		agent := new(Agent)
+		err := getJSON(b, id, agent)
+		if err != nil {
+			return err
+		}
+		agent.LastSeen = t
+		return putJSON(b, id, agent)
+	})
+}
+
+// SetAgentAvailable implements Store.SetAgentAvailable.
+func (s *Bolt) SetAgentAvailable(ctx context.Context, id string,
+	available bool) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAgents)
+		agent := new(Agent)
+		err := getJSON(b, id, agent)
+		if err != nil {
+			return err
+		}
+		agent.Unavailable = !available
+		return putJSON(b, id, agent)
+	})
+}
+
+// PutClient implements Store.PutClient.
+func (s *Bolt) PutClient(ctx context.Context, client *Client) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketClients), client.ID, client)
+	})
+}
+
+// GetClient implements Store.GetClient.
+func (s *Bolt) GetClient(ctx context.Context, id string) (*Client, error) {
+	client := new(Client)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketClients), id, client)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// ListClients implements Store.ListClients.
+func (s *Bolt) ListClients(ctx context.Context) ([]*Client, error) {
+	var result []*Client
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketClients).ForEach(func(k, v []byte) error {
+			client := new(Client)
+			err := json.Unmarshal(v, client)
+			if err != nil {
+				return err
+			}
+			result = append(result, client)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetClientLastActivity implements Store.SetClientLastActivity.
+func (s *Bolt) SetClientLastActivity(ctx context.Context, id string,
+	t time.Time) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketClients)
+		client := new(Client)
+		err := getJSON(b, id, client)
+		if err != nil {
+			return err
+		}
+		client.LastActivity = t
+		return putJSON(b, id, client)
+	})
+}
+
+// CancelRequest implements Store.CancelRequest.
+func (s *Bolt) CancelRequest(ctx context.Context, clientID,
+	requestID string) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketClients)
+		client := new(Client)
+		err := getJSON(b, clientID, client)
+		if err != nil {
+			return err
+		}
+		client.cancel(requestID)
+		return putJSON(b, clientID, client)
+	})
+}
+
+// DeleteClient implements Store.DeleteClient.
+func (s *Bolt) DeleteClient(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketClients)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// PutIdempotencyKey implements Store.PutIdempotencyKey.
+func (s *Bolt) PutIdempotencyKey(ctx context.Context, key string,
+	expires time.Time) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeys)
+
+		// Remove expired keys.
+		now := time.Now()
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			ik := new(IdempotencyKey)
+			if json.Unmarshal(v, ik) != nil || !now.Before(ik.Expires) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		if b.Get([]byte(key)) != nil {
+			return ErrExists
+		}
+		return putJSON(b, key, &IdempotencyKey{
+			Expires: expires,
+		})
+	})
+}
+
+// DeleteIdempotencyKey implements Store.DeleteIdempotencyKey.
+func (s *Bolt) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeys)
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Close implements Store.Close.
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,271 @@
+//
+// firestore.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	collectionAgents  = "agents"
+	collectionClients = "clients"
+	collectionKeys    = "idempotencyKeys"
+)
+
+// Firestore implements a Store with Google Cloud Firestore.
+type Firestore struct {
+	client *firestore.Client
+}
+
+// NewFirestore creates a new Firestore store for the project.
+func NewFirestore(ctx context.Context, projectID string) (*Firestore, error) {
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &Firestore{
+		client: client,
+	}, nil
+}
+
+// get reads the document into v. It returns ErrNotFound if the
+// document does not exist.
+func get(ctx context.Context, doc *firestore.DocumentRef,
+	v interface{}) error {
+
+	snap, err := doc.Get(ctx)
+	if snap != nil && !snap.Exists() {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return snap.DataTo(v)
+}
+
+// PutAgent implements Store.PutAgent.
+func (s *Firestore) PutAgent(ctx context.Context, agent *Agent) error {
+	_, err := s.client.Collection(collectionAgents).Doc(agent.ID).
+		Set(ctx, agent)
+	return err
+}
+
+// GetAgent implements Store.GetAgent.
+func (s *Firestore) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	agent := new(Agent)
+	err := get(ctx, s.client.Collection(collectionAgents).Doc(id), agent)
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// ListAgents implements Store.ListAgents.
+func (s *Firestore) ListAgents(ctx context.Context) ([]*Agent, error) {
+	snaps, err := s.client.Collection(collectionAgents).Documents(ctx).
+		GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Agent
+	for _, snap := range snaps {
+		agent := new(Agent)
+		err = snap.DataTo(agent)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, agent)
+	}
+	return result, nil
+}
+
+// SetAgentLastSeen implements Store.SetAgentLastSeen.
+func (s *Firestore) SetAgentLastSeen(ctx context.Context, id string,
+	t time.Time) error {
+
+	doc := s.client.Collection(collectionAgents).Doc(id)
+	_, err := doc.Update(ctx, []firestore.Update{
+		{
+			Path:  "lastSeen",
+			Value: t,
+		},
+	})
+	if err != nil {
+		snap, _ := doc.Get(ctx)
+		if snap != nil && !snap.Exists() {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+// SetAgentAvailable implements Store.SetAgentAvailable.
+func (s *Firestore) SetAgentAvailable(ctx context.Context, id string,
+	available bool) error {
+
+	doc := s.client.Collection(collectionAgents).Doc(id)
+	_, err := doc.Update(ctx, []firestore.Update{
+		{
+			Path:  "unavailable",
+			Value: !available,
+		},
+	})
+	if err != nil {
+		snap, _ := doc.Get(ctx)
+		if snap != nil && !snap.Exists() {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+// PutClient implements Store.PutClient.
+func (s *Firestore) PutClient(ctx context.Context, client *Client) error {
+	_, err := s.client.Collection(collectionClients).Doc(client.ID).
+		Set(ctx, client)
+	return err
+}
+
+// GetClient implements Store.GetClient.
+func (s *Firestore) GetClient(ctx context.Context, id string) (*Client, error) {
+	client := new(Client)
+	err := get(ctx, s.client.Collection(collectionClients).Doc(id), client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// ListClients implements Store.ListClients.
+func (s *Firestore) ListClients(ctx context.Context) ([]*Client, error) {
+	snaps, err := s.client.Collection(collectionClients).Documents(ctx).
+		GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Client
+	for _, snap := range snaps {
+		client := new(Client)
+		err = snap.DataTo(client)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, client)
+	}
+	return result, nil
+}
+
+// SetClientLastActivity implements Store.SetClientLastActivity.
+func (s *Firestore) SetClientLastActivity(ctx context.Context, id string,
+	t time.Time) error {
+
+	doc := s.client.Collection(collectionClients).Doc(id)
+	_, err := doc.Update(ctx, []firestore.Update{
+		{
+			Path:  "lastActivity",
+			Value: t,
+		},
+	})
+	if err != nil {
+		snap, _ := doc.Get(ctx)
+		if snap != nil && !snap.Exists() {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+// CancelRequest implements Store.CancelRequest.
+func (s *Firestore) CancelRequest(ctx context.Context, clientID,
+	requestID string) error {
+
+	doc := s.client.Collection(collectionClients).Doc(clientID)
+	return s.client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc)
+			if snap != nil && !snap.Exists() {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			client := new(Client)
+			err = snap.DataTo(client)
+			if err != nil {
+				return err
+			}
+			client.cancel(requestID)
+			return tx.Set(doc, client)
+		})
+}
+
+// DeleteClient implements Store.DeleteClient.
+func (s *Firestore) DeleteClient(ctx context.Context, id string) error {
+	doc := s.client.Collection(collectionClients).Doc(id)
+	snap, err := doc.Get(ctx)
+	if snap != nil && !snap.Exists() {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = doc.Delete(ctx)
+	return err
+}
+
+// PutIdempotencyKey implements Store.PutIdempotencyKey.
+func (s *Firestore) PutIdempotencyKey(ctx context.Context, key string,
+	expires time.Time) error {
+
+	doc := s.client.Collection(collectionKeys).Doc(key)
+	return s.client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc)
+			if snap == nil || snap.Exists() {
+				if err != nil {
+					return err
+				}
+				ik := new(IdempotencyKey)
+				err = snap.DataTo(ik)
+				if err != nil {
+					return err
+				}
+				if time.Now().Before(ik.Expires) {
+					return ErrExists
+				}
+			}
+			return tx.Set(doc, &IdempotencyKey{
+				Expires: expires,
+			})
+		})
+}
+
+// DeleteIdempotencyKey implements Store.DeleteIdempotencyKey.
+func (s *Firestore) DeleteIdempotencyKey(ctx context.Context,
+	key string) error {
+
+	doc := s.client.Collection(collectionKeys).Doc(key)
+	snap, err := doc.Get(ctx)
+	if snap != nil && !snap.Exists() {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = doc.Delete(ctx)
+	return err
+}
+
+// Close implements Store.Close.
+func (s *Firestore) Close() error {
+	return s.client.Close()
+}
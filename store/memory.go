@@ -0,0 +1,233 @@
+//
+// memory.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory implements an in-process Store. Its state is lost when the
+// process exits.
+type Memory struct {
+	m       sync.Mutex
+	agents  map[string]*Agent
+	clients map[string]*Client
+	keys    map[string]time.Time
+}
+
+// NewMemory creates a new in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		agents:  make(map[string]*Agent),
+		clients: make(map[string]*Client),
+		keys:    make(map[string]time.Time),
+	}
+}
+
+// PutAgent implements Store.PutAgent.
+func (s *Memory) PutAgent(ctx context.Context, agent *Agent) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	a := *agent
+	s.agents[agent.ID] = &a
+
+	return nil
+}
+
+// GetAgent implements Store.GetAgent.
+func (s *Memory) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	a := *agent
+	return &a, nil
+}
+
+// ListAgents implements Store.ListAgents.
+func (s *Memory) ListAgents(ctx context.Context) ([]*Agent, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var result []*Agent
+	for _, agent := range s.agents {
+		a := *agent
+		result = append(result, &a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// SetAgentLastSeen implements Store.SetAgentLastSeen.
+func (s *Memory) SetAgentLastSeen(ctx context.Context, id string,
+	t time.Time) error {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return ErrNotFound
+	}
+	agent.LastSeen = t
+
+	return nil
+}
+
+// SetAgentAvailable implements Store.SetAgentAvailable.
+func (s *Memory) SetAgentAvailable(ctx context.Context, id string,
+	available bool) error {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return ErrNotFound
+	}
+	agent.Unavailable = !available
+
+	return nil
+}
+
+// PutClient implements Store.PutClient.
+func (s *Memory) PutClient(ctx context.Context, client *Client) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	c := *client
+	s.clients[client.ID] = &c
+
+	return nil
+}
+
+// GetClient implements Store.GetClient.
+func (s *Memory) GetClient(ctx context.Context, id string) (*Client, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *client
+	return &c, nil
+}
+
+// ListClients implements Store.ListClients.
+func (s *Memory) ListClients(ctx context.Context) ([]*Client, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var result []*Client
+	for _, client := range s.clients {
+		c := *client
+		result = append(result, &c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// SetClientLastActivity implements Store.SetClientLastActivity.
+func (s *Memory) SetClientLastActivity(ctx context.Context, id string,
+	t time.Time) error {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return ErrNotFound
+	}
+	client.LastActivity = t
+
+	return nil
+}
+
+// CancelRequest implements Store.CancelRequest.
+func (s *Memory) CancelRequest(ctx context.Context, clientID,
+	requestID string) error {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	client, ok := s.clients[clientID]
+	if !ok {
+		return ErrNotFound
+	}
+	client.cancel(requestID)
+
+	return nil
+}
+
+// DeleteClient implements Store.DeleteClient.
+func (s *Memory) DeleteClient(ctx context.Context, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	_, ok := s.clients[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.clients, id)
+
+	return nil
+}
+
+// PutIdempotencyKey implements Store.PutIdempotencyKey.
+func (s *Memory) PutIdempotencyKey(ctx context.Context, key string,
+	expires time.Time) error {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	for k, t := range s.keys {
+		if !now.Before(t) {
+			delete(s.keys, k)
+		}
+	}
+	_, ok := s.keys[key]
+	if ok {
+		return ErrExists
+	}
+	s.keys[key] = expires
+
+	return nil
+}
+
+// DeleteIdempotencyKey implements Store.DeleteIdempotencyKey.
+func (s *Memory) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	_, ok := s.keys[key]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, key)
+
+	return nil
+}
+
+// Close implements Store.Close.
+func (s *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+//
+// store.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// MaxCancelled specifies how many cancelled request IDs are kept
+	// for a client session.
+	MaxCancelled = 32
+)
+
+var (
+	// ErrNotFound is returned when the requested object does not
+	// exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrExists is returned when the object already exists.
+	ErrExists = errors.New("already exists")
+)
+
+// Agent implements a registered agent.
+type Agent struct {
+	ID           string     `json:"id" firestore:"id"`
+	Name         string     `json:"name" firestore:"name"`
+	Owner        string     `json:"owner" firestore:"owner"`
+	Subject      string     `json:"subject" firestore:"subject"`
+	Created      time.Time  `json:"created" firestore:"created"`
+	LastSeen     time.Time  `json:"lastSeen" firestore:"lastSeen"`
+	Unavailable  bool       `json:"unavailable" firestore:"unavailable"`
+	Fingerprints []string   `json:"fingerprints" firestore:"fingerprints"`
+	Identities   []Identity `json:"identities" firestore:"identities"`
+	PublicKey    []byte     `json:"publicKey" firestore:"publicKey"`
+}
+
+// Identity implements an SSH identity advertised by an agent.
+type Identity struct {
+	Key     []byte `json:"key" firestore:"key"`
+	Comment string `json:"comment" firestore:"comment"`
+}
+
+// Client implements a client session.
+type Client struct {
+	ID           string        `json:"id" firestore:"id"`
+	Subject      string        `json:"subject" firestore:"subject"`
+	Agents       []string      `json:"agents" firestore:"agents"`
+	Created      time.Time     `json:"created" firestore:"created"`
+	LastActivity time.Time     `json:"lastActivity" firestore:"lastActivity"`
+	Lease        time.Duration `json:"lease" firestore:"lease"`
+	Cancelled    []string      `json:"cancelled" firestore:"cancelled"`
+}
+
+// IsCancelled tests if the client session has cancelled the request.
+func (c *Client) IsCancelled(requestID string) bool {
+	for _, id := range c.Cancelled {
+		if id == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+// cancel adds the request ID to the session's cancelled requests. At
+// most MaxCancelled latest request IDs are kept.
+func (c *Client) cancel(requestID string) {
+	if c.IsCancelled(requestID) {
+		return
+	}
+	c.Cancelled = append(c.Cancelled, requestID)
+	if len(c.Cancelled) > MaxCancelled {
+		c.Cancelled = c.Cancelled[len(c.Cancelled)-MaxCancelled:]
+	}
+}
+
+// Expired tests if the client session's lease has expired at the
+// time now. Sessions without a lease never expire.
+func (c *Client) Expired(now time.Time) bool {
+	if c.Lease <= 0 {
+		return false
+	}
+	lastActivity := c.LastActivity
+	if lastActivity.IsZero() {
+		lastActivity = c.Created
+	}
+	return now.Sub(lastActivity) > c.Lease
+}
+
+// HasAgent tests if the client session can use the agent.
+func (c *Client) HasAgent(id string) bool {
+	for _, agent := range c.Agents {
+		if agent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// IdempotencyKey implements a recorded idempotency key.
+type IdempotencyKey struct {
+	Expires time.Time `json:"expires" firestore:"expires"`
+}
+
+// Store implements persistent relay state.
+type Store interface {
+	// PutAgent adds or replaces the agent.
+	PutAgent(ctx context.Context, agent *Agent) error
+
+	// GetAgent returns the agent by its ID. It returns ErrNotFound
+	// if the agent does not exist.
+	GetAgent(ctx context.Context, id string) (*Agent, error)
+
+	// ListAgents returns all registered agents.
+	ListAgents(ctx context.Context) ([]*Agent, error)
+
+	// SetAgentLastSeen sets the agent's last seen time. It returns
+	// ErrNotFound if the agent does not exist.
+	SetAgentLastSeen(ctx context.Context, id string, t time.Time) error
+
+	// SetAgentAvailable sets the availability of the agent's local
+	// SSH agent. It returns ErrNotFound if the agent does not exist.
+	SetAgentAvailable(ctx context.Context, id string, available bool) error
+
+	// PutClient adds or replaces the client session.
+	PutClient(ctx context.Context, client *Client) error
+
+	// GetClient returns the client session by its ID. It returns
+	// ErrNotFound if the session does not exist.
+	GetClient(ctx context.Context, id string) (*Client, error)
+
+	// ListClients returns all client sessions.
+	ListClients(ctx context.Context) ([]*Client, error)
+
+	// SetClientLastActivity sets the client session's last activity
+	// time. It returns ErrNotFound if the session does not exist.
+	SetClientLastActivity(ctx context.Context, id string, t time.Time) error
+
+	// CancelRequest marks the client session's request cancelled.
+	// It returns ErrNotFound if the session does not exist.
+	CancelRequest(ctx context.Context, clientID, requestID string) error
+
+	// DeleteClient deletes the client session. It returns
+	// ErrNotFound if the session does not exist.
+	DeleteClient(ctx context.Context, id string) error
+
+	// PutIdempotencyKey records the idempotency key until the
+	// expiration time. It returns ErrExists if the key is already
+	// recorded and it has not expired.
+	PutIdempotencyKey(ctx context.Context, key string, expires time.Time) error
+
+	// DeleteIdempotencyKey deletes the idempotency key. It returns
+	// ErrNotFound if the key does not exist.
+	DeleteIdempotencyKey(ctx context.Context, key string) error
+
+	// Close closes the store and releases all its resources.
+	Close() error
+}
@@ -0,0 +1,282 @@
+//
+// store_test.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStore tests the Store interface semantics.
+func testStore(t *testing.T, newStore func(t *testing.T) (Store, func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"Agents", testAgents},
+		{"Clients", testClients},
+		{"IdempotencyKeys", testIdempotencyKeys},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, closeStore := newStore(t)
+			defer closeStore()
+			test.test(t, s)
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) (Store, func()) {
+		s := NewMemory()
+		return s, func() {
+			s.Close()
+		}
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) (Store, func()) {
+		dir, err := ioutil.TempDir("", "store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewBolt(filepath.Join(dir, "store.db"))
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func testAgents(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Second)
+
+	_, err := s.GetAgent(ctx, "a1")
+	if err != ErrNotFound {
+		t.Errorf("GetAgent of unknown agent: %v", err)
+	}
+	err = s.SetAgentLastSeen(ctx, "a1", now)
+	if err != ErrNotFound {
+		t.Errorf("SetAgentLastSeen of unknown agent: %v", err)
+	}
+	err = s.SetAgentAvailable(ctx, "a1", false)
+	if err != ErrNotFound {
+		t.Errorf("SetAgentAvailable of unknown agent: %v", err)
+	}
+
+	agent := &Agent{
+		ID:           "a1",
+		Name:         "laptop",
+		Owner:        "joe",
+		Subject:      "joe@example.com",
+		Created:      now,
+		LastSeen:     now,
+		Fingerprints: []string{"SHA256:fp"},
+		Identities: []Identity{
+			{
+				Key:     []byte{1, 2, 3},
+				Comment: "key",
+			},
+		},
+		PublicKey: []byte{4, 5, 6},
+	}
+	for _, a := range []*Agent{agent, {ID: "a2"}} {
+		err = s.PutAgent(ctx, a)
+		if err != nil {
+			t.Fatalf("PutAgent: %s", err)
+		}
+	}
+	got, err := s.GetAgent(ctx, "a1")
+	if err != nil {
+		t.Fatalf("GetAgent: %s", err)
+	}
+	if !reflect.DeepEqual(got, agent) {
+		t.Errorf("GetAgent: got %v, expected %v", got, agent)
+	}
+
+	// The returned agents are copies.
+	got.Name = "modified"
+	got, err = s.GetAgent(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != agent.Name {
+		t.Errorf("stored agent modified through GetAgent result")
+	}
+
+	later := now.Add(time.Minute)
+	err = s.SetAgentLastSeen(ctx, "a1", later)
+	if err != nil {
+		t.Fatalf("SetAgentLastSeen: %s", err)
+	}
+	err = s.SetAgentAvailable(ctx, "a1", false)
+	if err != nil {
+		t.Fatalf("SetAgentAvailable: %s", err)
+	}
+	got, err = s.GetAgent(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LastSeen.Equal(later) || !got.Unavailable {
+		t.Errorf("agent status not updated: %v %v", got.LastSeen,
+			got.Unavailable)
+	}
+
+	agents, err := s.ListAgents(ctx)
+	if err != nil {
+		t.Fatalf("ListAgents: %s", err)
+	}
+	if len(agents) != 2 || agents[0].ID != "a1" || agents[1].ID != "a2" {
+		t.Errorf("ListAgents: %v", agents)
+	}
+}
+
+func testClients(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Second)
+
+	_, err := s.GetClient(ctx, "c1")
+	if err != ErrNotFound {
+		t.Errorf("GetClient of unknown client: %v", err)
+	}
+	err = s.SetClientLastActivity(ctx, "c1", now)
+	if err != ErrNotFound {
+		t.Errorf("SetClientLastActivity of unknown client: %v", err)
+	}
+	err = s.CancelRequest(ctx, "c1", "1")
+	if err != ErrNotFound {
+		t.Errorf("CancelRequest of unknown client: %v", err)
+	}
+	err = s.DeleteClient(ctx, "c1")
+	if err != ErrNotFound {
+		t.Errorf("DeleteClient of unknown client: %v", err)
+	}
+
+	client := &Client{
+		ID:           "c1",
+		Subject:      "joe@example.com",
+		Agents:       []string{"a1", "a2"},
+		Created:      now,
+		LastActivity: now,
+		Lease:        time.Minute,
+	}
+	for _, c := range []*Client{client, {ID: "c2"}} {
+		err = s.PutClient(ctx, c)
+		if err != nil {
+			t.Fatalf("PutClient: %s", err)
+		}
+	}
+	got, err := s.GetClient(ctx, "c1")
+	if err != nil {
+		t.Fatalf("GetClient: %s", err)
+	}
+	if !reflect.DeepEqual(got, client) {
+		t.Errorf("GetClient: got %v, expected %v", got, client)
+	}
+	if !got.HasAgent("a2") || got.HasAgent("a3") {
+		t.Errorf("HasAgent: %v", got.Agents)
+	}
+
+	later := now.Add(time.Minute)
+	err = s.SetClientLastActivity(ctx, "c1", later)
+	if err != nil {
+		t.Fatalf("SetClientLastActivity: %s", err)
+	}
+
+	// Only the latest cancelled requests are kept.
+	for i := 0; i < MaxCancelled+2; i++ {
+		err = s.CancelRequest(ctx, "c1", string(rune('A'+i)))
+		if err != nil {
+			t.Fatalf("CancelRequest: %s", err)
+		}
+	}
+	err = s.CancelRequest(ctx, "c1", "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetClient(ctx, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LastActivity.Equal(later) {
+		t.Errorf("last activity not updated: %v", got.LastActivity)
+	}
+	if len(got.Cancelled) != MaxCancelled {
+		t.Errorf("%d cancelled requests, expected %d", len(got.Cancelled),
+			MaxCancelled)
+	}
+	if got.IsCancelled("A") || got.IsCancelled("B") || !got.IsCancelled("C") ||
+		!got.IsCancelled(string(rune('A'+MaxCancelled+1))) {
+		t.Errorf("cancelled requests: %v", got.Cancelled)
+	}
+
+	clients, err := s.ListClients(ctx)
+	if err != nil {
+		t.Fatalf("ListClients: %s", err)
+	}
+	if len(clients) != 2 || clients[0].ID != "c1" || clients[1].ID != "c2" {
+		t.Errorf("ListClients: %v", clients)
+	}
+
+	err = s.DeleteClient(ctx, "c1")
+	if err != nil {
+		t.Fatalf("DeleteClient: %s", err)
+	}
+	_, err = s.GetClient(ctx, "c1")
+	if err != ErrNotFound {
+		t.Errorf("GetClient of deleted client: %v", err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	err := s.DeleteIdempotencyKey(ctx, "key")
+	if err != ErrNotFound {
+		t.Errorf("DeleteIdempotencyKey of unknown key: %v", err)
+	}
+	err = s.PutIdempotencyKey(ctx, "key", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("PutIdempotencyKey: %s", err)
+	}
+	err = s.PutIdempotencyKey(ctx, "key", now.Add(time.Minute))
+	if err != ErrExists {
+		t.Errorf("PutIdempotencyKey of recorded key: %v", err)
+	}
+	err = s.DeleteIdempotencyKey(ctx, "key")
+	if err != nil {
+		t.Fatalf("DeleteIdempotencyKey: %s", err)
+	}
+	err = s.PutIdempotencyKey(ctx, "key", now.Add(time.Minute))
+	if err != nil {
+		t.Errorf("PutIdempotencyKey of deleted key: %v", err)
+	}
+
+	// Expired keys can be recorded again.
+	err = s.PutIdempotencyKey(ctx, "expired", now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutIdempotencyKey(ctx, "expired", now.Add(time.Minute))
+	if err != nil {
+		t.Errorf("PutIdempotencyKey of expired key: %v", err)
+	}
+}
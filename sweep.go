@@ -0,0 +1,106 @@
+//
+// sweep.go
+//
+// Copyright (c) 2020 Markku Rossi
+//
+// All rights reserved.
+//
+
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// ClientIdleTimeout specifies how long a client session without
+	// a lease can be idle before it is removed by the sweeper.
+	ClientIdleTimeout = time.Hour
+)
+
+// Sweep removes client sessions whose leases have expired. Sessions
+// without a lease are removed when they have been idle longer than
+// maxIdle. It deletes the sessions' response queues and returns the
+// IDs of the removed sessions. Sessions whose queues could not be
+// deleted are kept so that the next sweep retries them.
+func (relay *Relay) Sweep(ctx context.Context, maxIdle time.Duration) (
+	[]string, error) {
+
+	clients, err := relay.store.ListClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var removed []string
+
+	for _, client := range clients {
+		if client.Lease <= 0 {
+			lastActivity := client.LastActivity
+			if lastActivity.IsZero() {
+				lastActivity = client.Created
+			}
+			if now.Sub(lastActivity) <= maxIdle {
+				continue
+			}
+		} else if !client.Expired(now) {
+			continue
+		}
+		id, err := ParseID(client.ID)
+		if err != nil {
+			fmt.Printf("Sweep: invalid client ID %s: %s\n", client.ID, err)
+			continue
+		}
+		err = relay.deleteClient(ctx, id)
+		if err != nil {
+			fmt.Printf("Sweep: deleteClient %s: %s\n", client.ID, err)
+			continue
+		}
+		removed = append(removed, client.ID)
+	}
+	return removed, nil
+}
+
+// SweepHandler handles REST calls to the "/sweep" URI. It is called
+// periodically by a scheduler to remove idle client sessions. The
+// optional "idle" query parameter overrides the idle timeout.
+func (relay *Relay) SweepHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("%s: %s\n", r.Method, r.URL.Path)
+
+	principal := relay.authn.Authenticate(w, r)
+	if principal == nil {
+		return
+	}
+	if !requireScope(w, principal, ScopeAdmin) {
+		return
+	}
+	if r.Method != "POST" {
+		Errorf(w, http.StatusBadRequest, "Unsupported method %s", r.Method)
+		return
+	}
+
+	maxIdle := ClientIdleTimeout
+	if idle := r.URL.Query().Get("idle"); len(idle) > 0 {
+		d, err := time.ParseDuration(idle)
+		if err != nil || d <= 0 {
+			Errorf(w, http.StatusBadRequest, "Invalid idle timeout '%s'",
+				idle)
+			return
+		}
+		maxIdle = d
+	}
+
+	removed, err := relay.Sweep(r.Context(), maxIdle)
+	if err != nil {
+		Error500f(w, "Sweep: %s", err)
+		return
+	}
+	for _, id := range removed {
+		fmt.Printf("Sweep: removed client %s\n", id)
+	}
+	writeJSON(w, &SweepResult{
+		Removed: removed,
+	})
+}